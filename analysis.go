@@ -0,0 +1,231 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+var (
+	// positions of all sources type-checked in this session
+	analysisFileSet = token.NewFileSet()
+	// imports packages from the sources in GOROOT ; packages are type-checked once per session
+	sourceImporter = importer.ForCompiler(analysisFileSet, "source", nil)
+)
+
+// lastAnalysis holds the package of the last analysis with a position after all its entries ;
+// an expression is type-checked there as if it were the next entry. The package is nil if there was no analysis yet.
+var lastAnalysis struct {
+	pkg *types.Package
+	pos token.Pos
+}
+
+// checkExpression type-checks an expression as if it followed the entries of the last analysis.
+// Return nil if there was no analysis or the expression does not type-check there, e.g. it uses a package not imported yet.
+func checkExpression(expression ast.Expr) *types.Info {
+	if lastAnalysis.pkg == nil {
+		return nil
+	}
+	info := &types.Info{Types: map[ast.Expr]types.TypeAndValue{}, Uses: map[*ast.Ident]types.Object{}}
+	if err := types.CheckExpr(analysisFileSet, lastAnalysis.pkg, lastAnalysis.pos, expression, info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// analyze type-checks the program generated for all entries and records on each SourceHolder
+// the objects it defines and uses. Only objects of the session are recorded as defined:
+// top-level declarations and variables of main ; not those local to a block.
+// Return the first type error, if any ; holders are then left as they were.
+func analyze(sourceLines []SourceHolder) error {
+	// use a copy such that the line numbers of the last evaluation are kept
+	generated := append([]SourceHolder{}, sourceLines...)
+	imageVars := buildTemplateVars(generated, nil)
+	// packages are imported from the directory of the file which holds the go.mod of the session
+	fileName, files := workspacePath(imageName+".go"), []*ast.File{}
+	if len(packageName) > 0 {
+		// the entries are checked as part of the package
+		fileName = packageSourceName(imageName)
+		parsed, err := parsePackage(analysisFileSet)
+		if err != nil {
+			return err
+		}
+		files = parsed
+	}
+	file, err := parser.ParseFile(analysisFileSet, fileName, generateSource(imageVars), 0)
+	if err != nil {
+		return err
+	}
+	info := &types.Info{
+		Defs:   map[*ast.Ident]types.Object{},
+		Uses:   map[*ast.Ident]types.Object{},
+		Scopes: map[ast.Node]*types.Scope{},
+	}
+	config := types.Config{Importer: sourceImporter}
+	pkg, err := config.Check(programPackage(), analysisFileSet, append(files, file), info)
+	if err != nil {
+		return err
+	}
+	mainName := entryFunction()
+	main, ok := pkg.Scope().Lookup(mainName).(*types.Func)
+	if !ok {
+		return errors.New("no " + mainName + " function")
+	}
+	scopes := sessionScopes(file, info, generated)
+	scopes[main.Scope()] = true
+	// the innermost scope is the last block opened
+	innermost := main.Scope()
+	for each := range scopes {
+		if each != nil && each.Pos() > innermost.Pos() {
+			innermost = each
+		}
+	}
+	lastAnalysis.pkg, lastAnalysis.pos = pkg, innermost.End()-1
+	declareUnusedImports(info.Scopes[file], pkg, sourceLines)
+	session := func(object types.Object) bool {
+		if strings.HasPrefix(object.Name(), "rango_") || object.Name() == "_" {
+			return false
+		}
+		// methods have no parent scope
+		if function, ok := object.(*types.Func); ok && function.Type().(*types.Signature).Recv() != nil {
+			return true
+		}
+		return object.Parent() == pkg.Scope() || scopes[object.Parent()]
+	}
+	isField := func(object types.Object) bool {
+		variable, ok := object.(*types.Var)
+		return ok && variable.IsField()
+	}
+	defines := make([][]types.Object, len(sourceLines))
+	uses := make([][]types.Object, len(sourceLines))
+	holderAt := func(ident *ast.Ident) int {
+		position := analysisFileSet.Position(ident.Pos())
+		if position.Filename != fileName {
+			// a source of the package
+			return -1
+		}
+		line := position.Line
+		for i, each := range generated {
+			if each.LineNumber > 0 && line >= each.LineNumber && line < each.LineNumber+each.Lines() {
+				if last := each.LineNumber + each.Lines() - 1; line == last && position.Column > each.CodeEndColumn() {
+					// code appended by rango such as _ = x
+					return -1
+				}
+				return i
+			}
+		}
+		return -1
+	}
+	for ident, object := range info.Defs {
+		if object == nil || !session(object) {
+			continue
+		}
+		if i := holderAt(ident); i != -1 {
+			defines[i] = appendObject(defines[i], object)
+		}
+	}
+	for ident, object := range info.Uses {
+		// objects of the universe such as int or len are left out
+		if object.Pkg() == nil || (object.Pkg() == pkg && !session(object) && !isField(object)) {
+			continue
+		}
+		if i := holderAt(ident); i != -1 {
+			uses[i] = appendObject(uses[i], object)
+		}
+	}
+	for i := range sourceLines {
+		sourceLines[i].Analyzed = true
+		sourceLines[i].Defines = sortObjects(defines[i])
+		sourceLines[i].Uses = sortObjects(uses[i])
+	}
+	return nil
+}
+
+// declareUnusedImports declares the packages that no entry uses in the scope of the generated file.
+// They are imported for their side effects only (import _ "path") but expressions checked later may use them.
+func declareUnusedImports(fileScope *types.Scope, pkg *types.Package, sourceLines []SourceHolder) {
+	if fileScope == nil {
+		return
+	}
+	for _, each := range collectImports(sourceLines) {
+		name := each.Qualifier()
+		if name == "_" || name == "." || fileScope.Lookup(name) != nil {
+			continue
+		}
+		if imported, err := importPackage(each.Path); err == nil {
+			fileScope.Insert(types.NewPkgName(token.NoPos, pkg, name, imported))
+		}
+	}
+}
+
+// sessionScopes returns the scopes of the blocks opened for entries that declare variables again.
+// Each such block is the last block statement of the function that runs the entries (e.g. followed by os.Exit in a test)
+// or of the block opened before.
+func sessionScopes(file *ast.File, info *types.Info, generated []SourceHolder) map[*types.Scope]bool {
+	scopes := map[*types.Scope]bool{}
+	var list []ast.Stmt
+	for _, each := range file.Decls {
+		if function, ok := each.(*ast.FuncDecl); ok && function.Recv == nil && function.Name.Name == entryFunction() {
+			list = function.Body.List
+		}
+	}
+	for {
+		var block *ast.BlockStmt
+		for i := len(list) - 1; i >= 0 && block == nil; i-- {
+			block, _ = list[i].(*ast.BlockStmt)
+		}
+		if block == nil || !opensScopeAt(generated, analysisFileSet.Position(block.Lbrace)) {
+			break
+		}
+		scopes[info.Scopes[block]] = true
+		list = block.List
+	}
+	return scopes
+}
+
+// opensScopeAt returns whether the generated source opens a block for an entry at a position
+func opensScopeAt(generated []SourceHolder, position token.Position) bool {
+	for _, each := range generated {
+		if each.OpensScope && each.LineNumber == position.Line && len(each.OutputMarkSource())+1 == position.Column {
+			return true
+		}
+	}
+	return false
+}
+
+// appendObject adds an object unless already present
+func appendObject(objects []types.Object, object types.Object) []types.Object {
+	for _, each := range objects {
+		if each == object {
+			return objects
+		}
+	}
+	return append(objects, object)
+}
+
+// sortObjects sorts objects in the order of their position in the source
+func sortObjects(objects []types.Object) []types.Object {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Pos() < objects[j].Pos()
+	})
+	return objects
+}
+
+// typeString returns the name of a type as written in the entries ; types of the session are not qualified
+func typeString(typ types.Type) string {
+	return types.TypeString(typ, func(pkg *types.Package) string {
+		if pkg.Path() == programPackage() {
+			return ""
+		}
+		return pkg.Name()
+	})
+}
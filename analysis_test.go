@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestAnalyze(t *testing.T) {
+	newSession(Result{})
+	dispatch(`import "strings"`)
+	dispatch("type Point struct{ X, Y int }")
+	dispatch("p := Point{1, 2}")
+	dispatch(`s := strings.Repeat("a", p.X)`)
+	dispatch("for i := 0; i < 2; i++ { s += s }")
+	defines := map[string]string{}
+	uses := map[string]bool{}
+	for _, each := range sourceLines {
+		if !each.Analyzed {
+			t.Fatalf("not analyzed:%v", each)
+		}
+		for _, object := range each.Defines {
+			defines[object.Name()] = typeString(object.Type())
+		}
+		for _, object := range each.Uses {
+			uses[object.Name()] = true
+		}
+	}
+	if defines["p"] != "Point" || defines["s"] != "string" || defines["Point"] != "Point" {
+		t.Fatalf("defines=%v", defines)
+	}
+	// local to the for block
+	if _, ok := defines["i"]; ok {
+		t.Fatalf("defines=%v", defines)
+	}
+	if !uses["Repeat"] || !uses["p"] || !uses["X"] {
+		t.Fatalf("uses=%v", uses)
+	}
+	if !equal([]string{"p", "s"}, CollectVariables(sourceLines)) {
+		t.Fatalf("variables=%v", CollectVariables(sourceLines))
+	}
+}
+
+func TestAnalyzeRedeclarationInPackage(t *testing.T) {
+	inPackage(t)
+	newSession(Result{})
+	dispatch("a := 1")
+	dispatch(`a := "x"`)
+	dispatch("p := point{X: 1}")
+	if !isVariable("p") {
+		t.Fatal("p is not a variable")
+	}
+	if holder := enteredHolder(sourceLines, 2); len(holder.Defines) != 1 || typeString(holder.Defines[0].Type()) != "string" {
+		t.Fatalf("defines=%v", holder.Defines)
+	}
+	if holder := enteredHolder(sourceLines, 3); len(holder.Defines) != 1 || typeString(holder.Defines[0].Type()) != "point" {
+		t.Fatalf("defines=%v", holder.Defines)
+	}
+}
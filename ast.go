@@ -1,36 +1,214 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"go/ast"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
 )
 
+// IsExpressionStatement returns whether a line is a single expression statement, e.g. 1+2 or len(m)
 func IsExpressionStatement(line string) bool {
-	node, err := ParseStatement(line)
+	_, err := ParseStatements(line)
 	if err != nil {
 		log("parsing variables failed", err)
 		return false
 	}
-	av := new(AstVisitor)
-	ast.Walk(av, node)
-	return av.IsExpression
+	return parseExpression(line) != nil
+}
+
+// HasSideEffects returns whether the expression of a line calls a function or receives from a channel.
+// Calls that only compute a value, such as conversions, len or strconv.Atoi, do not count (see isValueCall).
+func HasSideEffects(line string) bool {
+	expression := parseExpression(line)
+	if expression == nil {
+		return false
+	}
+	info := checkExpression(expression)
+	effects := false
+	ast.Inspect(expression, func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.CallExpr:
+			if !isValueCall(x, info) {
+				effects = true
+			}
+		case *ast.UnaryExpr:
+			if x.Op == token.ARROW {
+				effects = true
+			}
+		case *ast.FuncLit:
+			// the body is not run by the expression
+			return false
+		}
+		return !effects
+	})
+	return effects
+}
+
+// builtin functions without side effects
+var pureBuiltins = map[string]bool{
+	"append": true, "cap": true, "complex": true, "imag": true, "len": true,
+	"make": true, "max": true, "min": true, "new": true, "real": true}
+
+// functions without side effects by the import path of their package ; nil if all functions of the package are
+var pureFunctions = map[string]map[string]bool{
+	"strings": nil, "strconv": nil, "math": nil, "math/bits": nil, "unicode": nil, "unicode/utf8": nil, "path": nil,
+	"fmt":    {"Sprint": true, "Sprintf": true, "Sprintln": true, "Errorf": true},
+	"errors": {"New": true, "Is": true, "Unwrap": true}}
+
+// isPureFunction returns whether a function of a package only computes a value
+func isPureFunction(importPath, name string) bool {
+	functions, ok := pureFunctions[importPath]
+	return ok && (functions == nil || functions[name])
+}
+
+// isValueCall returns whether a call only computes a value: a conversion, a builtin such as len or a function of pureFunctions.
+// Methods and functions of the session may change state. Without type information (info is nil)
+// the called function is recognized by its source.
+func isValueCall(call *ast.CallExpr, info *types.Info) bool {
+	fun := call.Fun
+	for {
+		paren, ok := fun.(*ast.ParenExpr)
+		if !ok {
+			break
+		}
+		fun = paren.X
+	}
+	if info != nil {
+		if value, ok := info.Types[call.Fun]; ok && value.IsType() {
+			return true
+		}
+		var object types.Object
+		switch x := fun.(type) {
+		case *ast.Ident:
+			object = info.Uses[x]
+		case *ast.SelectorExpr:
+			object = info.Uses[x.Sel]
+		}
+		switch object := object.(type) {
+		case *types.Builtin:
+			return pureBuiltins[object.Name()]
+		case *types.Func:
+			return object.Pkg() != nil && object.Type().(*types.Signature).Recv() == nil && isPureFunction(object.Pkg().Path(), object.Name())
+		}
+		return false
+	}
+	switch x := fun.(type) {
+	case *ast.ArrayType, *ast.MapType, *ast.ChanType, *ast.FuncType, *ast.InterfaceType, *ast.StructType, *ast.StarExpr:
+		// e.g. []byte("x")
+		return true
+	case *ast.Ident:
+		_, isType := types.Universe.Lookup(x.Name).(*types.TypeName)
+		return isType || pureBuiltins[x.Name]
+	case *ast.SelectorExpr:
+		qualifier, ok := x.X.(*ast.Ident)
+		if !ok || isVariable(qualifier.Name) {
+			return false
+		}
+		for importPath := range pureFunctions {
+			if importName(importPath) == qualifier.Name && isPureFunction(importPath, x.Sel.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CalledFunction returns the source of the function called by the expression of a line, e.g. fmt.Println.
+// Return empty if the expression is not a call.
+func CalledFunction(line string) string {
+	if call, ok := parseExpression(line).(*ast.CallExpr); ok {
+		return types.ExprString(call.Fun)
+	}
+	return ""
+}
+
+// parseExpression returns the expression if a line is a single expression statement, nil otherwise
+func parseExpression(line string) ast.Expr {
+	statements, err := ParseStatements(line)
+	if err != nil {
+		return nil
+	}
+	var found ast.Expr
+	count := 0
+	for _, each := range statements {
+		if _, empty := each.(*ast.EmptyStmt); empty {
+			continue
+		}
+		count++
+		if expression, ok := each.(*ast.ExprStmt); ok {
+			found = expression.X
+		}
+	}
+	if count != 1 {
+		return nil
+	}
+	return found
 }
 
-// ParseVariables parse the names of variables assigned or declared in a line
-func ParseVariables(line string) (assigned []string, declared []string, err error) {
-	node, err := ParseStatement(line)
+// ParseVariables parse the names of variables assigned, declared or mutated in a line.
+// A line can have multiple statements, e.g. a := 1; b := 2
+// Mutated are the root variables of e.g. p.X = 3, m["k"] = 1, n += 2 and i++
+func ParseVariables(line string) (assigned []string, declared []string, mutated []string, err error) {
+	statements, err := ParseStatements(line)
 	if err != nil {
 		log("parsing variables failed", err)
-		return assigned, declared, err
+		return assigned, declared, mutated, err
 	}
+	// collect across all statements of the line
 	av := new(AstVisitor)
-	ast.Walk(av, node)
-	return av.VariablesAssigned, av.VariablesDeclared, nil
+	for _, each := range statements {
+		ast.Walk(av, each)
+	}
+	return av.VariablesAssigned, av.VariablesDeclared, av.VariablesMutated, nil
+}
+
+// ParseDefinedNames parse the names of variables defined by the statements of a line using := or var.
+// Variables defined inside a block are local and not returned.
+func ParseDefinedNames(line string) []string {
+	statements, err := ParseStatements(line)
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, each := range statements {
+		switch stmt := each.(type) {
+		case *ast.AssignStmt:
+			if stmt.Tok == token.DEFINE {
+				for _, other := range stmt.Lhs {
+					if ident, ok := other.(*ast.Ident); ok && ident.Name != "_" {
+						names = append(names, ident.Name)
+					}
+				}
+			}
+		case *ast.DeclStmt:
+			if decl, ok := stmt.Decl.(*ast.GenDecl); ok && decl.Tok == token.VAR {
+				for _, spec := range decl.Specs {
+					for _, ident := range spec.(*ast.ValueSpec).Names {
+						if ident.Name != "_" {
+							names = append(names, ident.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// ImportSpec is a package imported by an entry
+type ImportSpec struct {
+	Name string // the name given to the package, _ or . ; empty if the package is known by its own name
+	Path string // the import path, unquoted
 }
 
-// ParseImports parse the name of the packages from the import declaration in a line
-func ParseImports(line string) ([]string, error) {
+// ParseImports parse the packages with their names from the import declarations in a line
+func ParseImports(line string) ([]ImportSpec, error) {
 	node, err := ParseImport(line)
 	if err != nil {
 		log("parsing imports failed", err)
@@ -41,21 +219,220 @@ func ParseImports(line string) ([]string, error) {
 	return av.Imports, nil
 }
 
+// ParseQualifiers returns the names used as qualifier (x in x.y) in a list of top-level declarations and statements
+func ParseQualifiers(declarations, statements []string) (map[string]bool, error) {
+	file, err := parseProgram(declarations, statements)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	ast.Inspect(file, func(node ast.Node) bool {
+		if selector, ok := node.(*ast.SelectorExpr); ok {
+			if ident, ok := selector.X.(*ast.Ident); ok {
+				names[ident.Name] = true
+			}
+		}
+		return true
+	})
+	return names, nil
+}
+
+// ParseIdentifiers returns the names used unqualified in a list of top-level declarations and statements.
+// Selected names (y in x.y) are left out.
+func ParseIdentifiers(declarations, statements []string) (map[string]bool, error) {
+	file, err := parseProgram(declarations, statements)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	// not the name of the package that wraps the sources
+	for _, each := range file.Decls {
+		ast.Inspect(each, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.SelectorExpr:
+				ast.Inspect(node.X, func(inner ast.Node) bool {
+					if ident, ok := inner.(*ast.Ident); ok {
+						names[ident.Name] = true
+					}
+					return true
+				})
+				return false
+			case *ast.Ident:
+				names[node.Name] = true
+			}
+			return true
+		})
+	}
+	return names, nil
+}
+
+// parseProgram parses a list of top-level declarations and statements as one file ; the statements are the body of a function
+func parseProgram(declarations, statements []string) (*ast.File, error) {
+	source := "package p\n" + strings.Join(declarations, "\n") + "\nfunc _(){\n" + strings.Join(statements, "\n") + "\n;}"
+	return parser.ParseFile(token.NewFileSet(), "", source, 0)
+}
+
+// CodeEnd returns the offset in the source after its last token such that Go code can be appended to its last line.
+// A trailing line comment is left out.
+func CodeEnd(source string) int {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(source))
+	var s scanner.Scanner
+	s.Init(file, []byte(source), nil, scanner.ScanComments)
+	end := len(source)
+	for {
+		pos, tok, literal := s.Scan()
+		switch {
+		case tok == token.EOF:
+			return end
+		case tok == token.COMMENT && strings.HasPrefix(literal, "//"):
+			// the code ends before it
+		case tok == token.SEMICOLON && literal == "\n":
+			// inserted at the end of a line
+		case len(literal) > 0:
+			end = file.Offset(pos) + len(literal)
+		default:
+			end = file.Offset(pos) + len(tok.String())
+		}
+	}
+}
+
+// IsIncomplete returns whether more lines are needed to complete the Go source of an entry.
+// This is the case for unbalanced braces, parens or brackets, unterminated raw strings or comments
+// and for source that the parser only rejects because it ends too early.
+func IsIncomplete(source string) bool {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(source))
+	unterminated := false
+	var s scanner.Scanner
+	s.Init(file, []byte(source), func(pos token.Position, msg string) {
+		if strings.HasPrefix(msg, "raw string literal not terminated") || strings.HasPrefix(msg, "comment not terminated") {
+			unterminated = true
+		}
+	}, 0)
+	depth := 0
+	for {
+		_, tok, _ := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		switch tok {
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			depth++
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			depth--
+		}
+	}
+	if unterminated || depth > 0 {
+		return true
+	}
+	if depth < 0 || IsDeclaration(source) {
+		return false
+	}
+	_, err := ParseStatement(source)
+	if list, ok := err.(scanner.ErrorList); ok && len(list) > 0 {
+		// the source is on lines 2 and further ; the error is on the line that closes the function
+		return list[0].Pos.Line > strings.Count(source, "\n")+2
+	}
+	return false
+}
+
+// IsDeclaration returns whether a line is a top-level declaration: a func, method, type, const or var block
+func IsDeclaration(line string) bool {
+	node, err := ParseDeclarationNode(line)
+	if err != nil {
+		return false
+	}
+	switch decl := node.(type) {
+	case *ast.FuncDecl:
+		return true
+	case *ast.GenDecl:
+		// a single var declaration is a statement of main
+		return decl.Tok == token.TYPE || decl.Tok == token.CONST || (decl.Tok == token.VAR && decl.Lparen.IsValid())
+	}
+	return false
+}
+
+// ParseDeclaration parse the names declared by a top-level declaration in a line.
+// Methods are named by their receiver type and method name, e.g. Point.String.
+// Variables declared by a var block are also returned separately.
+func ParseDeclaration(line string) (names []string, variables []string, err error) {
+	node, err := ParseDeclarationNode(line)
+	if err != nil {
+		log("parsing declaration failed", err)
+		return names, variables, err
+	}
+	switch decl := node.(type) {
+	case *ast.FuncDecl:
+		if decl.Recv != nil && len(decl.Recv.List) > 0 {
+			names = append(names, receiverTypeName(decl.Recv.List[0].Type)+"."+decl.Name.Name)
+		} else {
+			names = append(names, decl.Name.Name)
+		}
+	case *ast.GenDecl:
+		for _, each := range decl.Specs {
+			switch spec := each.(type) {
+			case *ast.TypeSpec:
+				names = append(names, spec.Name.Name)
+			case *ast.ValueSpec:
+				for _, other := range spec.Names {
+					names = append(names, other.Name)
+					if decl.Tok == token.VAR {
+						variables = append(variables, other.Name)
+					}
+				}
+			}
+		}
+	}
+	return names, variables, nil
+}
+
+// receiverTypeName returns the name of the type of a method receiver such as *Point or List[T]
+func receiverTypeName(expr ast.Expr) string {
+	switch x := expr.(type) {
+	case *ast.StarExpr:
+		return receiverTypeName(x.X)
+	case *ast.IndexExpr:
+		return receiverTypeName(x.X)
+	case *ast.IndexListExpr:
+		return receiverTypeName(x.X)
+	case *ast.Ident:
+		return x.Name
+	}
+	return ""
+}
+
 // AstVisitor implements a ast.Visitor and collect variable and import info
 type AstVisitor struct {
 	VariablesAssigned []string
 	VariablesDeclared []string
-	Imports           []string
+	VariablesMutated  []string
+	Imports           []ImportSpec
 	IsExpression      bool
 }
 
-// Visit inspects the type of a Node to detect a Assignment, Declaration or Import
+// Visit inspects the type of a Node to detect a Assignment, Declaration, Mutation or Import
 func (av *AstVisitor) Visit(node ast.Node) ast.Visitor {
 	switch node.(type) {
 	case *ast.AssignStmt:
-		for _, each := range node.(*ast.AssignStmt).Lhs {
-			av.VariablesAssigned = append(av.VariablesAssigned, each.(*ast.Ident).Name)
+		assign := node.(*ast.AssignStmt)
+		for _, each := range assign.Lhs {
+			ident, isIdent := each.(*ast.Ident)
+			if isIdent && (assign.Tok == token.ASSIGN || assign.Tok == token.DEFINE) {
+				if ident.Name != "_" {
+					av.VariablesAssigned = append(av.VariablesAssigned, ident.Name)
+				}
+				continue
+			}
+			// op-assign or assignment to a field, element or pointer
+			av.addMutated(each)
 		}
+	case *ast.IncDecStmt:
+		av.addMutated(node.(*ast.IncDecStmt).X)
+	case *ast.BlockStmt, *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt:
+		// variables assigned inside are local to the block ; only changes to others are of interest
+		ast.Inspect(node, av.inspectLocal)
+		return nil
 	case *ast.DeclStmt:
 		for _, each := range node.(*ast.DeclStmt).Decl.(*ast.GenDecl).Specs {
 			valueSpec, ok := each.(*ast.ValueSpec)
@@ -66,15 +443,65 @@ func (av *AstVisitor) Visit(node ast.Node) ast.Visitor {
 			}
 		}
 	case *ast.ImportSpec:
-		av.Imports = append(av.Imports, node.(*ast.ImportSpec).Path.Value)
+		spec := node.(*ast.ImportSpec)
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		av.Imports = append(av.Imports, ImportSpec{Name: specName(spec), Path: importPath})
 	case *ast.ExprStmt:
 		av.IsExpression = true
 	}
 	return av
 }
 
-// ParseStatement is a modified version of go/parser.ParseExpr
+// inspectLocal records the root variables of all assignments inside a block as mutated
+func (av *AstVisitor) inspectLocal(node ast.Node) bool {
+	switch stmt := node.(type) {
+	case *ast.AssignStmt:
+		for _, each := range stmt.Lhs {
+			av.addMutated(each)
+		}
+	case *ast.IncDecStmt:
+		av.addMutated(stmt.X)
+	}
+	return true
+}
+
+// addMutated records the root variable of an expression that is assigned to, if any
+func (av *AstVisitor) addMutated(expr ast.Expr) {
+	if root := rootVariable(expr); len(root) > 0 && root != "_" {
+		av.VariablesMutated = append(av.VariablesMutated, root)
+	}
+}
+
+// rootVariable returns the name of the variable that is changed by assigning to an expression
+// such as p in p.X, m in m["k"], s in s[1:], p in *p and a in a.b[i].c ; empty if there is none (e.g. f().X)
+func rootVariable(expr ast.Expr) string {
+	switch x := expr.(type) {
+	case *ast.Ident:
+		return x.Name
+	case *ast.SelectorExpr:
+		return rootVariable(x.X)
+	case *ast.IndexExpr:
+		return rootVariable(x.X)
+	case *ast.StarExpr:
+		return rootVariable(x.X)
+	case *ast.ParenExpr:
+		return rootVariable(x.X)
+	}
+	return ""
+}
+
+// ParseStatement returns the first statement of a line
 func ParseStatement(x string) (ast.Stmt, error) {
+	statements, err := ParseStatements(x)
+	if err != nil {
+		return nil, err
+	}
+	return statements[0], nil
+}
+
+// ParseStatements is a modified version of go/parser.ParseExpr.
+// It returns all statements of a line, e.g. a := 1; b := 2
+func ParseStatements(x string) ([]ast.Stmt, error) {
 	// parse x within the context of a complete package for correct scopes;
 	// put x alone on a separate line (handles line comments), followed by a ';'
 	// to force an error if the expression is incomplete
@@ -82,10 +509,24 @@ func ParseStatement(x string) (ast.Stmt, error) {
 	if err != nil {
 		return nil, err
 	}
-	return file.Decls[0].(*ast.FuncDecl).Body.List[0], nil
+	return file.Decls[0].(*ast.FuncDecl).Body.List, nil
+}
+
+// ParseDeclarationNode is a modified version of go/parser.ParseExpr
+func ParseDeclarationNode(x string) (ast.Decl, error) {
+	// parse x as the only top-level declaration of a package
+	file, err := parser.ParseFile(token.NewFileSet(), "", "package p\n"+x+"\n", 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Decls) != 1 {
+		return nil, fmt.Errorf("expected one declaration, found %d", len(file.Decls))
+	}
+	return file.Decls[0], nil
 }
 
-// ParseImport is a modified version of go/parser.ParseExpr
+// ParseImport is a modified version of go/parser.ParseExpr.
+// The line must only hold import declarations.
 func ParseImport(x string) (ast.Node, error) {
 	// parse x within the context of a complete package for correct scopes;
 	// put x alone on a separate line (handles line comments), followed by a ';'
@@ -94,5 +535,10 @@ func ParseImport(x string) (ast.Node, error) {
 	if err != nil {
 		return nil, err
 	}
-	return file.Decls[0], nil
+	for _, each := range file.Decls {
+		if decl, ok := each.(*ast.GenDecl); !ok || decl.Tok != token.IMPORT {
+			return nil, errors.New("expected import declarations only")
+		}
+	}
+	return file, nil
 }
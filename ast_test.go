@@ -20,6 +20,44 @@ var lines = []struct {
 	{"1+2", []string{}, []string{}, true},
 }
 
+func TestParseVariablesOfMultipleStatements(t *testing.T) {
+	assigned, declared, _, err := ParseVariables("a := 1; var b = 2; c = a + b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal([]string{"a", "c"}, assigned) || !equal([]string{"b"}, declared) {
+		t.Fatalf("assigned=%v declared=%v", assigned, declared)
+	}
+}
+
+var mutations = []struct {
+	line    string
+	mutated []string
+}{
+	{"p.X = 3", []string{"p"}},
+	{`m["k"] = 1`, []string{"m"}},
+	{"counts[i] += 2", []string{"counts"}},
+	{"n *= 2", []string{"n"}},
+	{"i++", []string{"i"}},
+	{"*p = 4", []string{"p"}},
+	{"a.b[0].c--", []string{"a"}},
+	{"f().X = 1", nil},
+	{"_ = x", nil},
+	{"for i := range counts { counts[i] += 2 }", []string{"counts"}},
+}
+
+func TestParseMutatedVariables(t *testing.T) {
+	for i, each := range mutations {
+		assigned, _, mutated, err := ParseVariables(each.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(assigned) > 0 || !equal(each.mutated, mutated) {
+			t.Fatalf("i=%d assigned=%v mutated=%v", i, assigned, mutated)
+		}
+	}
+}
+
 func TestParseVariables(t *testing.T) {
 	for i, each := range lines {
 		node, err := ParseStatement(each.line)
@@ -56,6 +94,25 @@ func TestParseImports(t *testing.T) {
 	}
 }
 
+func TestParseImportSpecs(t *testing.T) {
+	specs, err := ParseImports("import ( s \"strings\" ; _ \"embed\" ); import . `math`")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportSpec{{Name: "s", Path: "strings"}, {Name: "_", Path: "embed"}, {Name: ".", Path: "math"}}
+	if len(specs) != len(want) {
+		t.Fatalf("specs=%v", specs)
+	}
+	for i, each := range want {
+		if specs[i] != each {
+			t.Fatalf("specs=%v", specs)
+		}
+	}
+	if _, err := ParseImports(`import "fmt"; func f() {}`); err == nil {
+		t.Fatal("not only imports")
+	}
+}
+
 func equal(one []string, other []string) bool {
 	if len(one) != len(other) {
 		return false
@@ -68,3 +125,97 @@ func equal(one []string, other []string) bool {
 	}
 	return true
 }
+
+var declarations = []struct {
+	line      string
+	isdecl    bool
+	names     []string
+	variables []string
+}{
+	{"func double(x int) int { return 2*x }", true, []string{"double"}, nil},
+	{"func (p *Point) Move() {}", true, []string{"Point.Move"}, nil},
+	{"type Point struct{X,Y int}", true, []string{"Point"}, nil},
+	{"const ( A = 1; B = 2 )", true, []string{"A", "B"}, nil},
+	{"var ( c int; d = 1 )", true, []string{"c", "d"}, []string{"c", "d"}},
+	{"var e = 1", false, nil, nil},
+	{"func() {}()", false, nil, nil},
+}
+
+func TestParseDeclaration(t *testing.T) {
+	for i, each := range declarations {
+		if IsDeclaration(each.line) != each.isdecl {
+			t.Fatal("i=", i)
+		}
+		if !each.isdecl {
+			continue
+		}
+		names, variables, err := ParseDeclaration(each.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal(each.names, names) || !equal(each.variables, variables) {
+			t.Fatal("i=", i)
+		}
+	}
+}
+
+var incompletes = []struct {
+	source     string
+	incomplete bool
+}{
+	{"for i := 0; i < 3; i++ {", true},
+	{"s := `raw", true},
+	{"f(1,", true},
+	{"var (", true},
+	{"a := 1", false},
+	{"if a > 0 {\n}", false},
+	{"func f() {}", false},
+}
+
+func TestIsIncomplete(t *testing.T) {
+	for i, each := range incompletes {
+		if IsIncomplete(each.source) != each.incomplete {
+			t.Fatal("i=", i)
+		}
+	}
+}
+
+var expressions = []struct {
+	line    string
+	isexpr  bool
+	effects bool
+	called  string
+}{
+	{"1+2", true, false, ""},
+	{"len(m)", true, false, "len"},
+	{"strings.ToUpper(s)", true, false, "strings.ToUpper"},
+	{"int64(3)", true, false, "int64"},
+	{`[]byte("x")`, true, false, "[]byte"},
+	{`fmt.Sprintf("%d", 1)`, true, false, "fmt.Sprintf"},
+	{"fmt.Println(1)", true, true, "fmt.Println"},
+	{`b.WriteString("x")`, true, true, "b.WriteString"},
+	{"f()", true, true, "f"},
+	{"<-ch", true, true, ""},
+	{"func() { f() }", true, false, ""},
+	{"a := 1", false, false, ""},
+	{"f(); g()", false, false, ""},
+}
+
+func TestExpressionStatements(t *testing.T) {
+	for i, each := range expressions {
+		if IsExpressionStatement(each.line) != each.isexpr || HasSideEffects(each.line) != each.effects || CalledFunction(each.line) != each.called {
+			t.Fatal("i=", i)
+		}
+	}
+}
+
+func TestParseIdentifiers(t *testing.T) {
+	names, err := ParseIdentifiers(nil, []string{"t := time.Now()"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not the name of the package that wraps the source
+	if !names["t"] || !names["time"] || names["Now"] || names["p"] {
+		t.Fatalf("names=%v", names)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// import paths of the packages that can be imported by their name ; built when first needed
+	packageIndex map[string][]string
+	// the changes of the session go.mod when the index was built
+	packageIndexModules int
+	// choosePackage returns the import path for a package name that matches more than one package ; empty if none is chosen
+	choosePackage = askPackage
+)
+
+// addMissingImports imports the packages of qualifiers reported by the compiler as undefined (e.g. strings in strings.ToUpper).
+// An import belongs to the entry that uses it such that undoing the entry also removes the import.
+// Return whether any was added.
+func addMissingImports(diagnostics []string) bool {
+	added := map[string]bool{}
+	for _, each := range diagnostics {
+		name, holder := undefinedQualifier(sourceLines, each)
+		if holder == nil || added[name] {
+			continue
+		}
+		spec := ImportSpec{Path: findPackage(name)}
+		if len(spec.Path) == 0 {
+			continue
+		}
+		if importName(spec.Path) != name {
+			// e.g. math/rand/v2 or gopkg.in/yaml.v3
+			spec.Name = name
+		}
+		if specs, err := newImports(sourceLines, []ImportSpec{spec}, holder.EntryCount); err != nil || len(specs) == 0 {
+			// imported already ; the compiler reports the entry if the package is imported by another name
+			if err != nil {
+				fmt.Printf("[rango] %v\n", err)
+			}
+			continue
+		}
+		source := importSource([]ImportSpec{spec})
+		fmt.Printf("[rango] %s\n", source)
+		at := holderIndex(sourceLines, holder)
+		imported := NewImport(holder.EntryCount, source, []ImportSpec{spec})
+		sourceLines = append(sourceLines[:at], append([]SourceHolder{imported}, sourceLines[at:]...)...)
+		added[name] = true
+	}
+	return len(added) > 0
+}
+
+// undefinedQualifier returns the name and the holder of a qualifier (x in x.y) that a compiler message reports as undefined.
+// Return nil if the message is about something else.
+func undefinedQualifier(sourceLines []SourceHolder, diagnostic string) (string, *SourceHolder) {
+	match := compilerDiagnostic.FindStringSubmatch(diagnostic)
+	if match == nil || !strings.HasPrefix(match[4], "undefined: ") {
+		return "", nil
+	}
+	name := strings.TrimPrefix(match[4], "undefined: ")
+	line, _ := strconv.Atoi(match[2])
+	column, _ := strconv.Atoi(match[3])
+	where, ok := locate(sourceLines, line, column)
+	if !ok {
+		return "", nil
+	}
+	holder := where.holder
+	declarations, statements := []string{}, []string{holder.Source}
+	if Declaration == holder.Type {
+		declarations, statements = statements, declarations
+	}
+	if qualifiers, err := ParseQualifiers(declarations, statements); err != nil || !qualifiers[name] {
+		return "", nil
+	}
+	return name, holder
+}
+
+// holderIndex returns the index of a holder in the entries
+func holderIndex(sourceLines []SourceHolder, holder *SourceHolder) int {
+	for i := range sourceLines {
+		if &sourceLines[i] == holder {
+			return i
+		}
+	}
+	return len(sourceLines)
+}
+
+// findPackage returns the import path of the package with a name ; empty if there is none.
+// If more than one package has that name then the user chooses.
+func findPackage(name string) string {
+	if packageIndex == nil || packageIndexModules != moduleChanges {
+		packageIndex, packageIndexModules = buildPackageIndex(), moduleChanges
+	}
+	paths := packageIndex[name]
+	switch len(paths) {
+	case 0:
+		return ""
+	case 1:
+		return paths[0]
+	}
+	return choosePackage(name, paths)
+}
+
+// buildPackageIndex lists the importable packages of the standard library (GOROOT/src) and of the modules
+// of the session go.mod (or of the package) by their name
+func buildPackageIndex() map[string][]string {
+	index := map[string][]string{}
+	patterns := []string{"std", "all"}
+	// the packages of required modules are not part of all until imported
+	if modules, err := goCommand("list", "-m", "-f", "{{if not .Main}}{{.Path}}/...{{end}}", "all").Output(); err == nil {
+		patterns = append(patterns, strings.Fields(string(modules))...)
+	}
+	listed, _ := goCommand(append([]string{"list", "-e", "-f", "{{.ImportPath}} {{.Name}} {{.Dir}}"}, patterns...)...).Output()
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(listed))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 || seen[fields[0]] || !isImportable(fields[0], fields[1]) || fields[2] == packageDir {
+			// the entries are part of the package in the current directory
+			continue
+		}
+		seen[fields[0]] = true
+		index[fields[1]] = append(index[fields[1]], fields[0])
+	}
+	for _, each := range index {
+		sort.Strings(each)
+	}
+	return index
+}
+
+// isImportable returns whether the entries can import a package
+func isImportable(importPath, name string) bool {
+	if name == "main" || strings.HasSuffix(name, "_test") {
+		return false
+	}
+	for _, each := range strings.Split(importPath, "/") {
+		if each == "internal" || each == "vendor" || each == "testdata" {
+			return false
+		}
+	}
+	return true
+}
+
+// importName returns the name of a package as derived from its import path, e.g. rand for math/rand/v2
+func importName(importPath string) string {
+	base := path.Base(importPath)
+	if len(base) > 1 && base[0] == 'v' && strings.Trim(base[1:], "0123456789") == "" && importPath != base {
+		base = path.Base(path.Dir(importPath))
+	}
+	return strings.Split(base, ".")[0]
+}
+
+// askPackage lets the user choose between the import paths of packages with the same name
+func askPackage(name string, paths []string) string {
+	for {
+		fmt.Printf("[rango] %s is one of:\n", name)
+		for i, each := range paths {
+			fmt.Printf("\t%d) %s\n", i+1, each)
+		}
+		answer := readLine(fmt.Sprintf("import which (1-%d or none)? ", len(paths)))
+		if answer == "" || answer == "none" {
+			return ""
+		}
+		if choice, err := strconv.Atoi(answer); err == nil && choice >= 1 && choice <= len(paths) {
+			return paths[choice-1]
+		}
+	}
+}
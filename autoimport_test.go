@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestImportName(t *testing.T) {
+	for path, name := range map[string]string{"strings": "strings", "math/rand/v2": "rand", "gopkg.in/yaml.v3": "yaml", "v2": "v2"} {
+		if got := importName(path); got != name {
+			t.Fatalf("path=%s name=%s", path, got)
+		}
+	}
+}
+
+func TestAddMissingImports(t *testing.T) {
+	newSession(Result{Stdout: "\x00rango:1\x00"})
+	defer func() { packageIndex, choosePackage = nil, askPackage }()
+	packageIndex, packageIndexModules = map[string][]string{"strings": {"strings"}, "rand": {"crypto/rand", "math/rand"}}, moduleChanges
+	choosePackage = func(name string, paths []string) string { return paths[1] }
+	dispatch(`s := strings.ToUpper("a") + fmt.Sprint(rand.Int())`)
+	buildTemplateVars(sourceLines, nil)
+	line := sourceLines[0].LineNumber
+	diagnostics := []string{
+		fmt.Sprintf("./generated_by_rango.go:%d:6: undefined: strings", line),
+		fmt.Sprintf("./generated_by_rango.go:%d:43: undefined: rand", line),
+		fmt.Sprintf("./generated_by_rango.go:%d:1: undefined: s", line+1)}
+	if !addMissingImports(diagnostics) {
+		t.Fatal("no imports added")
+	}
+	if len(sourceLines) < 3 || sourceLines[0].Source != `import "strings"` || sourceLines[1].Source != `import "math/rand"` {
+		t.Fatalf("sourceLines=%v", sourceLines)
+	}
+	if sourceLines[0].EntryCount != 1 || sourceLines[1].EntryCount != 1 {
+		t.Fatal("imports do not belong to the entry")
+	}
+	// already imported
+	buildTemplateVars(sourceLines, nil)
+	if addMissingImports([]string{fmt.Sprintf("./generated_by_rango.go:%d:6: undefined: strings", sourceLines[2].LineNumber)}) {
+		t.Fatal("imported again")
+	}
+	// imported by another name
+	sourceLines[0].Source, sourceLines[0].Imports = `import str "strings"`, []ImportSpec{{Name: "str", Path: "strings"}}
+	if addMissingImports([]string{fmt.Sprintf("./generated_by_rango.go:%d:6: undefined: strings", sourceLines[2].LineNumber)}) {
+		t.Fatal("imported by two names")
+	}
+}
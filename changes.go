@@ -24,10 +24,19 @@ func processChanges() {
 	}
 	defer file.Close()
 	in := bufio.NewReader(file)
+	entry := ""
 	for {
 		entered, err := in.ReadString('\n')
 		if len(entered) > 0 {
-			handleSource(strings.TrimRight(entered, "\n"), UpdateSourceOnly) // without newline
+			// entries of multiple lines are complete once the Go source is
+			if len(entry) > 0 {
+				entry += "\n"
+			}
+			entry += strings.TrimRight(entered, "\n") // without newline
+			if err == io.EOF || !IsIncomplete(entry) {
+				handleSource(entry, UpdateSourceOnly)
+				entry = ""
+			}
 		}
 		if err == io.EOF {
 			break
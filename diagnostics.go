@@ -0,0 +1,250 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// matches a compiler message such as ./generated_by_rango.go:9:16: undefined: b
+var compilerDiagnostic = regexp.MustCompile(`^(\S+\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+// location is a position in the source entered by the user
+type location struct {
+	holder *SourceHolder // the holder of the entry as entered by the user
+	text   string        // the line of source as entered by the user
+	column int           // 1-based column in text ; 0 if unknown
+	print  bool          // true if produced by =<expression> which is not an entry
+}
+
+// locate returns the location in the entries of a line and column in the generated program.
+// Return false if the line is not produced from an entry (e.g. part of the program template).
+func locate(sourceLines []SourceHolder, line, column int) (location, bool) {
+	for i := range sourceLines {
+		each := &sourceLines[i]
+		if each.LineNumber == 0 || line < each.LineNumber || line >= each.LineNumber+each.Lines() {
+			continue
+		}
+		offset := line - each.LineNumber
+		text := strings.Split(each.Source, "\n")[offset]
+		if offset == each.Lines()-1 && column > each.CodeEndColumn() {
+			// in the code that rango appends, e.g. _ = x
+			column = 0
+		}
+		if offset == 0 && column > 0 {
+			column -= len(each.CodePrefix())
+		}
+		if Print == each.Type && strings.HasPrefix(each.Source, printExpressionBegin) {
+			// produced by =<expression> or an expression entry that is not kept
+			expression := strings.TrimSuffix(each.Source[len(printExpressionBegin):], "))")
+			entered := each.Entered
+			if len(entered) == 0 {
+				entered = "=" + expression
+			}
+			return location{holder: each, text: entered, column: column - len(printExpressionBegin) + len(entered) - len(expression), print: true}, true
+		}
+		if each.Hidden {
+			// attribute to the entry that produced it
+			entered := enteredHolder(sourceLines, each.EntryCount)
+			if entered == nil {
+				return location{}, false
+			}
+			return location{holder: entered, text: entered.Source}, true
+		}
+		return location{holder: each, text: text, column: column}, true
+	}
+	return location{}, false
+}
+
+// enteredHolder returns the first holder that is not hidden for an entry count, nil if none
+func enteredHolder(sourceLines []SourceHolder, entryCount int) *SourceHolder {
+	for i, each := range sourceLines {
+		if each.EntryCount == entryCount && !each.Hidden {
+			return &sourceLines[i]
+		}
+	}
+	return nil
+}
+
+// entry returns the name of the entry followed by its source line
+func (l location) entry() string {
+	if l.print {
+		return "print: " + l.text
+	}
+	return fmt.Sprintf("entry %d: %s", l.holder.EntryCount, l.text)
+}
+
+// describe returns the message for the entry followed by its source with a caret under the column
+func (l location) describe(message string) string {
+	var buf bytes.Buffer
+	if l.print {
+		fmt.Fprintf(&buf, "print: %s\n\t%s", message, l.text)
+	} else {
+		fmt.Fprintf(&buf, "entry %d: %s\n\t%s", l.holder.EntryCount, message, l.text)
+	}
+	if l.column > 0 && l.column <= len(l.text)+1 {
+		buf.WriteString("\n\t")
+		// keep tabs such that the caret lines up
+		for _, each := range l.text[:l.column-1] {
+			if each == '\t' {
+				buf.WriteRune('\t')
+			} else {
+				buf.WriteRune(' ')
+			}
+		}
+		buf.WriteString("^")
+	}
+	return buf.String()
+}
+
+// translateDiagnostic rewrites a compiler message about the generated program in terms of the entries
+func translateDiagnostic(sourceLines []SourceHolder, diagnostic string) string {
+	match := compilerDiagnostic.FindStringSubmatch(diagnostic)
+	if match == nil {
+		return diagnostic
+	}
+	line, _ := strconv.Atoi(match[2])
+	column, _ := strconv.Atoi(match[3])
+	where, ok := locate(sourceLines, line, column)
+	if !ok {
+		return fmt.Sprintf("[rango] generated code: %s", match[4])
+	}
+	return where.describe(match[4])
+}
+
+// inGeneratedCode returns whether any compiler message is about the code generated by rango rather than an entry
+func inGeneratedCode(sourceLines []SourceHolder, diagnostics []string) bool {
+	for _, each := range diagnostics {
+		match := compilerDiagnostic.FindStringSubmatch(each)
+		if match == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(match[2])
+		if _, ok := locate(sourceLines, line, 0); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// voidExpression returns the holder of an expression with printed results if the compiler reports that it has no value, nil otherwise
+func voidExpression(sourceLines []SourceHolder, diagnostic string) *SourceHolder {
+	match := compilerDiagnostic.FindStringSubmatch(diagnostic)
+	if match == nil || !strings.HasSuffix(match[4], "(no value) used as value") {
+		return nil
+	}
+	line, _ := strconv.Atoi(match[2])
+	column, _ := strconv.Atoi(match[3])
+	where, ok := locate(sourceLines, line, column)
+	if !ok || where.print || !where.holder.PrintsResults {
+		return nil
+	}
+	return where.holder
+}
+
+// matches the location of a frame in a goroutine stack trace such as /tmp/generated_by_rango.go:20 +0xfb
+var traceLocation = regexp.MustCompile(`^\t(\S+\.go):(\d+)( \+0x[0-9a-f]+)?$`)
+
+// isGeneratedFile returns whether a file is a Go source generated for the entries
+func isGeneratedFile(file string) bool {
+	base := filepath.Base(file)
+	if base == imageName+".go" || base == imageName+"_test.go" {
+		return true
+	}
+	// sources of plugins are numbered
+	number := strings.TrimSuffix(strings.TrimPrefix(base, imageName+"_"), ".go")
+	_, err := strconv.Atoi(number)
+	return err == nil && number != base
+}
+
+// isScaffoldingFrame returns whether a frame of a stack trace belongs to code of rango instead of an entry
+func isScaffoldingFrame(function, file string) bool {
+	return strings.Contains(function, ".rango_") ||
+		strings.HasPrefix(function, "panic(") ||
+		strings.HasPrefix(function, "runtime/debug.Stack(") ||
+		filepath.Base(file) == hostName(imageName)+".go" ||
+		// the test framework that runs the entries inside a package
+		(len(packageName) > 0 && (strings.HasPrefix(strings.TrimPrefix(function, "created by "), "testing.") || filepath.Base(file) == "_testmain.go"))
+}
+
+// translateTrace rewrites the frames of goroutine stack traces in the output of a program.
+// Locations in the generated source are replaced by the entry and its source.
+// Unless debugging, frames of rango itself are left out.
+func translateTrace(sourceLines []SourceHolder, output string) string {
+	translator := &traceTranslator{sourceLines: sourceLines}
+	kept := []string{}
+	for _, each := range strings.Split(output, "\n") {
+		kept = append(kept, translator.line(each)...)
+	}
+	kept = append(kept, translator.flush()...)
+	return strings.Join(kept, "\n")
+}
+
+// traceTranslator rewrites the frames of goroutine stack traces line by line.
+// A frame is a function line followed by a location line ; each line is held until the next one is known.
+type traceTranslator struct {
+	sourceLines []SourceHolder
+	pending     *string // line that can be the function of a frame
+}
+
+// line takes the next line of output and returns the lines that can be shown
+func (t *traceTranslator) line(text string) []string {
+	if t.pending == nil {
+		return t.hold(text)
+	}
+	function := *t.pending
+	match := traceLocation.FindStringSubmatch(text)
+	if match == nil {
+		t.pending = nil
+		return append([]string{function}, t.hold(text)...)
+	}
+	t.pending = nil
+	file := match[1]
+	if isScaffoldingFrame(function, file) && !*DEBUG {
+		return nil
+	}
+	line, _ := strconv.Atoi(match[2])
+	if where, ok := locateFrame(t.sourceLines, file, line); ok {
+		return []string{function, "\t" + where.entry()}
+	}
+	return []string{function, text}
+}
+
+// locateFrame returns the location in the entries of a frame of a goroutine stack trace.
+// Return false if the frame is not in a Go source generated for the entries.
+func locateFrame(sourceLines []SourceHolder, file string, line int) (location, bool) {
+	if holders, ok := pluginHolders[filepath.Base(file)]; ok {
+		// the plugin that started the goroutine can be an earlier one
+		return locate(holders, line, 0)
+	}
+	if !isGeneratedFile(file) {
+		return location{}, false
+	}
+	return locate(sourceLines, line, 0)
+}
+
+// hold keeps a line if it can be the function of a frame, e.g. main.main() ; otherwise it is returned
+func (t *traceTranslator) hold(text string) []string {
+	if strings.HasSuffix(text, ")") || strings.HasPrefix(text, "created by ") {
+		t.pending = &text
+		return nil
+	}
+	return []string{text}
+}
+
+// flush returns the line held, if any
+func (t *traceTranslator) flush() []string {
+	if t.pending == nil {
+		return nil
+	}
+	function := *t.pending
+	t.pending = nil
+	return []string{function}
+}
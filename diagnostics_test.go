@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTranslateDiagnostic(t *testing.T) {
+	lines := []SourceHolder{}
+	lines = NewVariableDecl(1, "a := 1", []string{"a"}).AppendTo(lines)
+	lines = NewStatement(2, "b := c + a").AppendTo(lines)
+	lines = NewPrint(2, printExpressionBegin+"zz))").AppendTo(lines)
+	vars := buildTemplateVars(lines, nil)
+	decl, stmt, print := vars.Statements[0], vars.Statements[1], vars.Statements[2]
+
+	got := translateDiagnostic(lines, "./generated_by_rango.go:"+strconv.Itoa(stmt.LineNumber)+":21: undefined: c")
+	if want := "entry 2: undefined: c\n\tb := c + a\n\t     ^"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	// code appended by rango is attributed to the entry
+	got = translateDiagnostic(lines, "./generated_by_rango.go:"+strconv.Itoa(decl.LineNumber)+":"+strconv.Itoa(len(decl.OutputMarkSource()+decl.Code())-4)+": undefined: a")
+	if want := "entry 1: undefined: a\n\ta := 1"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	got = translateDiagnostic(lines, "./generated_by_rango.go:"+strconv.Itoa(print.LineNumber)+":"+strconv.Itoa(len(print.OutputMarkSource()+printExpressionBegin)+1)+": undefined: zz")
+	if want := "print: undefined: zz\n\t=zz\n\t ^"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	// an expression entry is printed as entered
+	lines[len(lines)-1].Entered = "zz"
+	got = translateDiagnostic(lines, "./generated_by_rango.go:"+strconv.Itoa(print.LineNumber)+":"+strconv.Itoa(len(print.OutputMarkSource()+printExpressionBegin)+1)+": undefined: zz")
+	if want := "print: undefined: zz\n\tzz\n\t^"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	got = translateDiagnostic(lines, "./generated_by_rango.go:1:1: unexpected")
+	if want := "[rango] generated code: unexpected"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestTranslateTrace(t *testing.T) {
+	lines := []SourceHolder{}
+	lines = NewStatement(1, `panic("boom")`).AppendTo(lines)
+	vars := buildTemplateVars(lines, nil)
+	trace := "panic: boom\n\ngoroutine 1 [running]:\nmain.rango_first(...)\n\t/tmp/generated_by_rango.go:6\nmain.main()\n\t/tmp/generated_by_rango.go:" +
+		strconv.Itoa(vars.Statements[0].LineNumber) + " +0x25\n"
+	got := translateTrace(lines, trace)
+	if want := "panic: boom\n\ngoroutine 1 [running]:\nmain.main()\n\tentry 1: panic(\"boom\")\n"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
@@ -9,7 +9,7 @@ Install
 		go install ...rango
 
 Run
-		rango [projectname]
+		rango [-snapshot|-plugin] [-keep] [-timeout duration] [-limit mem=512M,cpu=10s,files=256] [-package=false] [projectname]
 
 Example session
 	> rango
@@ -26,33 +26,112 @@ Example session
 
 Commands
 		.q(uit)		exit rango
-		.v(ars)		show all variable names
+		.v(ars) [pattern]	show the variables with their type, value and declaring entry ; the pattern (e.g. user*) selects by name
 		.s(ource)	print the source entered since startup		
 		.u(undo)	the last entry
+		.o(ut) [N]	show the output of entry N, the latest entry if omitted
 		!<source>		execute this source only once
+		.timeout [duration]	stop a program that runs longer than the duration (e.g. 5s) ; 0 or off for no limit
+		.stdin [file|-]	programs read the file as standard input ; - for the terminal
+		.limit [mem=512M] [cpu=10s] [files=256]	limit the resources of programs ; 0 removes a limit, off removes all
+		.require [module@version]	require a module from the local module cache ; module@none removes it
+		.replace [path=>dir]	use the module in a local directory (with a go.mod) ; .replace path removes it
+		.imports [remove name|path]	show the imports with the entries that use them ; remove one, naming the entries that still use it
 
 Features
-	import declaration
+	import declaration ; a package used without one (e.g. strings.ToUpper) is imported automatically, asking if its name is ambiguous
+	imports with a name (str "strings"), blank (_) or dot (.) ; a package imported again by the same name is left out ; another name for it, or a name already given to another package, is refused
+	top-level declarations: func, method, type, const and var ( ... ) blocks ; entering a declaration of the same name replaces the earlier one ; a grouped declaration is replaced as a whole
 	(almost) any go source that you can put inside the main() function
+	declaring a variable again (a := "text" after a := 1) replaces it, possibly with another type ; undo restores the earlier one
+	expressions such as 1+2 or strings.Split(s, ",") print their results ; multiple results as a tuple and a non-nil error separately
+	expressions that only compute a value (e.g. int64(n), strconv.Atoi(s) or fmt.Sprintf) are printed like =<expression> and not kept as entries
+	multi-line entries: while the Go source is incomplete (e.g. an open brace) rango prompts with ... for more lines ; an empty line ends the entry
 	if <projectname> is given on startup then
 		if a <projectname>.changes file exists then rango will process its contents first.
 		all entries are logged in a <projectname>.changes file.
 
 Requirements
 	Installation of Go 1+ SDK
-	Because it depends on sh (e.g. bash) it only runs on a Go supported *nix OS
+	It only runs on a Go supported *nix OS
 
 
 How it is made
 
 Rango uses a generate-compile-run loop.
 Successively, for each new command line entry, a new program is generated in Go, compiled in Go and run on your machine.
-Any compiler error of the generated source is captured and printed by rango.
-The output (stdout and stderr) of the generated program is captured and printed by rango.
+Any compiler error of the generated source is captured and printed by rango, naming the entry and its source.
+If the generated program panics then the locations in its stack trace are replaced by the entry and its source.
+Frames of rango itself are only shown with the -debug option. An exit (os.Exit, log.Fatal) is reported with its status.
+The go tool and the generated program are run directly ; their stdout and stderr are captured separately.
+While the program runs, its output is shown as it is printed ; each line on stderr is labelled with [stderr].
+Because all entries are run again, the generated program marks the start of the output of each entry.
+Only the output of the latest entry is shown ; the output of earlier entries is available using the .o command.
+
+A program that hangs (e.g. for {} or a blocked channel receive) is stopped by pressing Ctrl-C or when the timeout expires.
+Programs run in their own process group ; Ctrl-C kills that group (not rango), the latest entry is undone and rango prompts again.
+A stopped program is first sent SIGQUIT such that it writes the stacks of its goroutines, which rango then summarizes:
+per goroutine its state (e.g. chan receive) and its frames as entries and their source ; frames of the runtime are left out.
+A deadlock reported by the Go runtime (all goroutines are asleep) is summarized the same way.
+
+Programs can be limited in memory (data segment), cpu time and open files ; a shell sets these limits (setrlimit) before it runs the program.
+A program that exceeds the memory or cpu limit is killed and reported as such, e.g. killed: exceeded memory limit at entry 12.
+With -plugin the limits apply to the host process as a whole ; changing them starts a new host.
+
+While a program runs, what is typed on the terminal is its standard input (e.g. for fmt.Scan or bufio.Scanner) ; Ctrl-D ends it.
+The input read by each entry is recorded ; when the entries are run again, they read their recorded input first.
+Input typed ahead that a program does not read is not recorded ; with -plugin the next entry reads it.
+With .stdin a file is read instead of the terminal ; the part read by a program is recorded for the latest entry
+and the next entry continues reading after it.
+Between prompts the terminal is not in raw mode. The plugin host reads the plugins to run from file descriptor 3 ; its standard input is left to the plugins.
+
+With the -snapshot option, the generated program saves the values of all variables (using encoding/gob) at the end of main.
+The next generated program then restores these values instead of running the earlier entries again.
+It declares them with their static types ; a variable of an interface type gets the value restored as its own type.
+Variables of var ( ... ) declarations are saved too and assigned again, unless the declaration was entered again since.
+This keeps values such as time.Now() stable and avoids repeating side effects.
+Values that cannot be encoded without loss (e.g. files, functions or channels) or whose types cannot be written are not restored ;
+the entries that refer to those variables are replayed instead, as are the entries that refer to the variables these use.
+
+With the -plugin option (Linux, macOS, FreeBSD), rango starts one long-lived host process.
+Each new entry is compiled as a plugin (-buildmode=plugin) that the host loads and runs.
+Variables are kept in a registry of the host such that goroutines, open files and connections survive entries.
+Each plugin declares the variables of earlier entries with their static types and takes their values from the registry.
+Types declared by the entries differ per plugin ; the entries that declare or use variables of such types are run again.
+Each plugin has its own variables of var ( ... ) declarations ; they are also kept in the registry and assigned from it.
+Undo removes the entry from the source but cannot undo its effects on the host.
+If the host process stops (e.g. os.Exit, Ctrl-C or the timeout) then a new host is started and all entries are run again,
+as they are when the declarations of the restored variables do not compile.
+
+After each entry, rango type-checks the generated program in-process (go/types, importing packages from the GOROOT sources).
+Each entry then knows the objects it defines and uses with their types ; these are the variables listed by .v.
+
+All generated files are written to a temporary workspace directory of the session which is locked by the process id of rango.
+The workspace is removed on exit ; with the -keep option it is kept to inspect the generated files.
+Workspaces left behind by a crashed session are removed by the next session. Programs still run in the current directory.
+The workspace holds the go.mod of the session which .require and .replace change using the go tool.
+Modules are resolved from the local module cache only (GOPROXY=off) ; the go tool adds missing requirements of replaced modules.
+
+If rango is started in a directory with a Go package then the entries are part of that package.
+Unexported functions, types and package variables (also of its internal tests) can then be used directly.
+The generated source is an internal test (TestRango) of the package ; go test -c compiles it from the workspace using -overlay,
+such that nothing is written to the package directory. The go.mod of the package is used ; -plugin is not supported.
+The -package=false option makes the entries a program of their own.
+
+If the compiler reports a qualifier (strings in strings.ToUpper) as undefined then rango looks up its package by name
+in the standard library (GOROOT/src) and the modules of the session (or package) and compiles again with the import.
+The import is shown and belongs to the entry that uses it, such that undo removes it ; imports for a print are not kept.
+
+Imports and variables need not be used yet. The generated source imports a package that no entry uses
+(by its name, alias or exported names for a dot import) for its side effects only (import _ "path")
+and uses each variable right after its declaration (x := f(); _ = x). Its own packages are imported as rango_fmt, rango_os, ...
+such that entries can import them too.
+
+Each of these strategies is an Evaluator that produces a Result with the captured stdout and stderr,
+the exit code, the duration of the run and the compiler diagnostics.
 
 Todo
 
-	interpret compiler errors and translate line numbers
 	use goreadline? termbox-go? for better cursor handling (up,down,complete...)
 
 (c) 2013, Ernest Micklei. MIT License
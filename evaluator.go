@@ -0,0 +1,103 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Evaluator runs the Go program made from all entries of a session
+type Evaluator interface {
+	// Evaluate runs the entries and reports the outcome ; the last entry is the one to evaluate
+	Evaluate(sourceLines []SourceHolder) Result
+	// Forget is called when all entries starting at a given entry count are undone
+	Forget(from int)
+}
+
+// Result holds the outcome of evaluating the entries of a session
+type Result struct {
+	Kind        int            // one of NoError,GenerationError,CompilationError,ExecutionError
+	Err         error          // reason for failure, nil if Kind is NoError
+	Stdout      string         // captured standard output of the program
+	Stderr      string         // captured standard error of the program ; or a message explaining the failure
+	ExitCode    int            // exit code of the program
+	Signal      syscall.Signal // signal that killed the program, 0 if none
+	Duration    time.Duration  // how long the program ran, not including the compilation
+	Diagnostics []string       // messages of the compiler, if Kind is CompilationError
+	Shown       bool           // true if the output of the latest entry was shown while the program ran
+}
+
+// Failed returns whether the evaluation did not complete
+func (r Result) Failed() bool {
+	return r.Err != nil
+}
+
+// failure creates a Result for an evaluation that failed
+func failure(kind int, err error, message string) Result {
+	return Result{Kind: kind, Err: err, Stderr: message, ExitCode: exitCode(err)}
+}
+
+// compilationFailure creates a Result that holds the messages of the compiler
+func compilationFailure(err error, stdout, stderr string) Result {
+	result := failure(CompilationError, err, stderr)
+	result.Stdout = stdout
+	for _, each := range strings.Split(stdout+stderr, "\n") {
+		// skip empty lines and package headers such as "# command-line-arguments"
+		if len(each) > 0 && !strings.HasPrefix(each, "#") {
+			result.Diagnostics = append(result.Diagnostics, each)
+		}
+	}
+	return result
+}
+
+// exitCode returns the exit code of a process from the error of running it
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitError, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
+// exitSignal returns the signal that killed a process from the error of running it, 0 if none
+func exitSignal(err error) syscall.Signal {
+	if exitError, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return status.Signal()
+		}
+	}
+	return 0
+}
+
+// compileRunEvaluator generates, compiles and runs a new program for every evaluation ; all entries are replayed
+type compileRunEvaluator struct {
+	imageName string
+}
+
+// Evaluate is part of Evaluator
+func (e compileRunEvaluator) Evaluate(sourceLines []SourceHolder) Result {
+	return generate_compile_run(e.imageName, buildTemplateVars(sourceLines, nil))
+}
+
+// Forget is part of Evaluator
+func (e compileRunEvaluator) Forget(from int) {}
+
+// newEvaluator returns the Evaluator selected by the command line options
+func newEvaluator(imageName string) Evaluator {
+	if *PluginHost {
+		return &pluginEvaluator{imageName: imageName}
+	}
+	if *Snapshot {
+		return newSnapshotEvaluator(imageName)
+	}
+	return compileRunEvaluator{imageName: imageName}
+}
@@ -6,133 +6,319 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"text/template"
+	"time"
 )
 
-var temporaryShellScriptName = "rangorun"
-
-// Generate_compile_run takes a list of Go source lines, create a Go program from it, compiles that source and runs that program.
+// Generate_compile_run takes the template variables, create a Go program from it, compiles that source and runs that program.
 // Return the captured output from the compilation or the execution of the Go program.
-func generate_compile_run(imageName string, sourceLines []SourceHolder) (string, error, int) {
+func generate_compile_run(imageName string, imageVars templateVars) Result {
 	// generate
-	gosource := fmt.Sprintf("%s.go", imageName)
-	err := generate(gosource, sourceLines)
+	gosource := workspacePath(imageName + ".go")
+	err := generate(gosource, imageVars)
 	if err != nil {
-		return fmt.Sprintf("[rango] generate Go source failed"), err, GenerationError
+		return failure(GenerationError, err, "[rango] generate Go source failed")
 	}
 	// build
-	command := fmt.Sprintf("go build %s.go", imageName)
-	output, err := execCommand(imageName, command)
+	executable := workspacePath(imageName)
+	build, args := goCommand("build", "-o", executable, gosource), []string{}
+	if len(packageName) > 0 {
+		if build, err = packageTestCommand(imageName, gosource, executable); err != nil {
+			return failure(GenerationError, err, "[rango] generate overlay failed")
+		}
+		args = packageTestArgs()
+	}
+	stdout, stderr, err := runCommand(build, false, nil)
 	if !*DEBUG {
 		defer os.Remove(gosource)
 	}
 	if err != nil {
-		return output, err, CompilationError
+		return compilationFailure(err, stdout, stderr)
 	}
-	// run
-	command = fmt.Sprintf("./%s", imageName)
-	defer os.Remove(imageName)
-	output, err = execCommand(imageName, command)
+	// run ; in the current directory of rango
+	defer os.Remove(executable)
+	start := time.Now()
+	stdout, stderr, err = runCommand(programCommand(executable, programLimits, args...), true, replayedInput(imageVars))
+	result := Result{Stdout: string(removeTestFailure([]byte(stdout))), Stderr: stderr, ExitCode: exitCode(err), Signal: exitSignal(err), Duration: time.Since(start), Shown: live != nil}
 	if err != nil {
-		return output, err, ExecutionError
+		result.Kind, result.Err = ExecutionError, err
+		return result
 	}
 	// success
-	return output, nil, NoError
+	result.Kind = NoError
+	return result
+}
+
+// generate produces a Go source file from the template variables
+func generate(goSourceFile string, imageVars templateVars) error {
+	return ioutil.WriteFile(goSourceFile, generateSource(imageVars), 0644)
 }
 
-// generate produces a Go source file from a list of Go code sourceLines
-func generate(goSourceFile string, sourceLines []SourceHolder) error {
+// generateSource produces the Go source from the template variables
+func generateSource(imageVars templateVars) []byte {
 	t := template.Must(template.New("image").Parse(imageSourceTemplate()))
 	var sourceBuffer bytes.Buffer
-	t.Execute(&sourceBuffer, buildTemplateVars(sourceLines))
-	return ioutil.WriteFile(goSourceFile, sourceBuffer.Bytes(), 0644)
+	t.Execute(&sourceBuffer, imageVars)
+	return sourceBuffer.Bytes()
 }
 
-func execCommand(imageName, command string) (string, error) {
-	logName := fmt.Sprintf("%s.exec.log", imageName)
-
-	// In order to capture the output of command, a temporary script is generated and executed by the shell
-	// Note: using the script contents in a Command, Run/Start it while capturing Stdout & Stdout via Pipes does not work.
-	script := fmt.Sprintf("%s > %s 2>&1", command, logName)
-	buf := new(bytes.Buffer)
-	buf.WriteString(script)
-	ioutil.WriteFile(temporaryShellScriptName, buf.Bytes(), os.ModePerm)
-	// clean up afterwards
-	defer os.Remove(temporaryShellScriptName)
-
-	cmd := exec.Command("sh", temporaryShellScriptName)
-	runError := cmd.Run()
-
-	// The captured output has been written to a temporary log file
-	file, err := os.Open(logName)
-	if err != nil {
-		return "[rango] open output failed", err
+// runCommand runs a command in its own process group and returns its captured standard output and standard error.
+// The command is stopped by Ctrl-C. If the command is a generated program then its output is shown live (if enabled),
+// it reads the replayed input followed by new input and it is also stopped if it runs longer than the timeout.
+func runCommand(cmd *exec.Cmd, program bool, replayed []byte) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if program && live != nil {
+		liveStdout, liveStderr := live.writers()
+		defer live.end()
+		cmd.Stdout = io.MultiWriter(&stdout, liveStdout)
+		cmd.Stderr = io.MultiWriter(&stderr, liveStderr)
 	}
-	// make sure it is closed before return (and removal)
-	defer file.Close()
-	// clean up afterwards
-	defer os.Remove(logName)
-
-	logBytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		return "[rango] read output failed", err
+	var stdin, terminal *os.File
+	if program {
+		var err error
+		if readsTerminal() {
+			stdin, terminal, err = os.Pipe()
+		} else {
+			var path string
+			if path, err = writeInputFile(replayed); err == nil {
+				stdin, err = os.Open(path)
+			}
+		}
+		if err != nil {
+			return "", err.Error(), err
+		}
+		// only the program reads its input
+		defer stdin.Close()
+		cmd.Stdin = stdin
 	}
-	return string(logBytes), runError
+	cmd.SysProcAttr = newProcessGroup()
+	if err := cmd.Start(); err != nil {
+		if terminal != nil {
+			terminal.Close()
+		}
+		stderr.WriteString(err.Error())
+		return stdout.String(), stderr.String(), err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	if terminal != nil {
+		given := forwardInput(terminal, stdin, true, replayed, nil)
+		defer func() {
+			latestInput = given.stop()
+		}()
+	} else if program {
+		defer func() {
+			// the program shares the offset of the input file
+			offset, _ := stdin.Seek(0, io.SeekCurrent)
+			latestInput = inputGiven(stdin.Name(), len(replayed), offset)
+		}()
+	}
+	err := waitProcessGroup(cmd.Process.Pid, done, program)
+	return stdout.String(), stderr.String(), err
 }
 
-// buildTemplateVars creates a templateVars struct from the list of code sourceLines
-func buildTemplateVars(sourceLines []SourceHolder) templateVars {
-	imageVars := new(templateVars)
+// buildTemplateVars creates a templateVars struct from the list of code sourceLines.
+// If a snapshot is given then the entries it covers are left out ; their variables must be restored instead.
+func buildTemplateVars(sourceLines []SourceHolder, restore *snapshot) templateVars {
+	imageVars := &templateVars{Package: programPackage(), Main: "main()"}
+	if len(packageName) > 0 {
+		imageVars.Main, imageVars.Test = packageTestName+"(*rango_testing.T)", true
+	}
+	imports := []*SourceHolder{}
 	for i, each := range sourceLines {
+		// holders not part of this program have no line number
+		sourceLines[i].LineNumber = 0
 		switch each.Type {
 		case Import:
-			imageVars.Imports = append(imageVars.Imports, &sourceLines[i])
+			imports = append(imports, &sourceLines[i])
+		case Declaration:
+			if !IsReplaced(sourceLines, i) {
+				imageVars.Declarations = append(imageVars.Declarations, &sourceLines[i])
+			}
 		case Print:
 			// only preserve prints of the last entry
 			if i == len(sourceLines)-1 {
 				imageVars.Statements = append(imageVars.Statements, &sourceLines[i])
 			}
 		default:
-			imageVars.Statements = append(imageVars.Statements, &sourceLines[i])
+			if restore == nil || each.EntryCount > restore.EntryCount || restore.Replayed[each.EntryCount] {
+				imageVars.Statements = append(imageVars.Statements, &sourceLines[i])
+			}
 		}
 	}
+	imageVars.Imports = imports
+	// the types of restored variables import their packages themselves (see RestoreImports)
+	markUnusedImports(imports, imageVars.Declarations, imageVars.Statements)
 	// assign line numbers
 	lineNumber := 3
 	for _, each := range imageVars.Imports {
 		each.LineNumber = lineNumber
-		lineNumber++
+		lineNumber += each.Lines()
+	}
+	for _, each := range imageVars.Declarations {
+		each.LineNumber = lineNumber
+		lineNumber += each.Lines()
 	}
-	lineNumber += 3
+	// skip the lines of rango_first, rango_mark and the start of main
+	lineNumber += 9
+	mark := 0
 	for _, each := range imageVars.Statements {
 		each.LineNumber = lineNumber
-		lineNumber++
+		lineNumber += each.Lines()
+		// mark the first statement of each entry and the print
+		each.MarksOutput = each.OutputMark() != mark
+		mark = each.OutputMark()
+		if each.OpensScope {
+			imageVars.CloseScopes += " }"
+		}
 	}
 	return *imageVars
 }
 
+// sourcesOf returns the Go source of each holder
+func sourcesOf(holders []*SourceHolder) []string {
+	sources := []string{}
+	for _, each := range holders {
+		sources = append(sources, each.Source)
+	}
+	return sources
+}
+
+// holders returns copies of the holders that are part of the program, with their line numbers
+func (t templateVars) holders() []SourceHolder {
+	holders := []SourceHolder{}
+	for _, each := range [][]*SourceHolder{t.Imports, t.Declarations, t.Statements} {
+		for _, holder := range each {
+			holders = append(holders, *holder)
+		}
+	}
+	return holders
+}
+
 // templateVars holds the template variables for the Go source to evaluate
 type templateVars struct {
-	Imports    []*SourceHolder
-	Statements []*SourceHolder
+	Imports      []*SourceHolder
+	Declarations []*SourceHolder
+	Statements   []*SourceHolder
+	Package      string // Name of the package of the Go source
+	Main         string // Signature of the function that runs the statements
+	Test         bool   // If true then Main is a test of the package ; it exits such that the test framework does not report
+	Snapshot     bool   // If true then the program includes the functions to save and restore variables
+	Restore      string // Go source that restores the variables of a snapshot
+	// Go source that imports the packages of the types of restored variables, if needed
+	RestoreImports string
+	Save           string // Go source that saves the variables at the end of main
+	CloseScopes    string // Go source that closes the blocks opened by entries that declare variables again
 }
 
 // imageSourceTemplate returns a Go program template that requires templateVars to produce Go source
 func imageSourceTemplate() string {
-	return `package main
-import "fmt"
-{{range .Imports}}{{.Source}} 			// {{.LineNumber}}
+	return `package {{.Package}}
+import rango_fmt "fmt"; import rango_os "os"{{if .Test}}; import rango_testing "testing"{{end}}{{if .Snapshot}}; import (rango_bytes "bytes"; rango_gob "encoding/gob"; rango_ioutil "io/ioutil"; rango_reflect "reflect"){{end}}{{.RestoreImports}}
+{{range .Imports}}{{.Code}} 			// {{.LineNumber}}
+{{end}}{{range .Declarations}}{{.Source}} 			// {{.LineNumber}}
 {{end}}
 func rango_first(value ...interface{}) (interface{}) {
 	return value[0]
 }
-func main() {
-fmt.Print("")
-{{range .Statements}}{{.Source}} 		// {{.LineNumber}}
-{{end}}
+func rango_mark(entry int) {
+	rango_fmt.Printf("%s%d%s", "\x00rango:", entry, "\x00"); rango_fmt.Fprintf(rango_os.Stderr, "%s%d%s", "\x00rango:", entry, "\x00")
+}
+func {{.Main}} {
+rango_fmt.Print(""){{with .Restore}}; {{.}}{{end}}
+{{range .Statements}}{{.OutputMarkSource}}{{.Code}} 		// {{.LineNumber}}
+{{end}}{{.Save}}{{.CloseScopes}}{{if .Test}}
+rango_os.Exit(0){{end}}
+}
+func rango_results(values ...interface{}) {
+	if last := values[len(values)-1]; len(values) > 1 {
+		// the last result is an error ; show it separately if not nil
+		if err, isError := last.(error); isError || last == nil {
+			values = values[:len(values)-1]
+			if err != nil {
+				defer rango_fmt.Printf("\nerror: %v", err)
+			}
+		}
+	}
+	if len(values) == 1 {
+		rango_fmt.Printf("%v", values[0])
+		return
+	}
+	rango_fmt.Print("(")
+	for i, each := range values {
+		if i > 0 {
+			rango_fmt.Print(", ")
+		}
+		rango_fmt.Printf("%v", each)
+	}
+	rango_fmt.Print(")")
+}
+{{if .Snapshot}}
+type rango_value struct {
+	Type string
+	Data []byte
+}
+func rango_save(file string, values map[string]interface{}) {
+	saved := map[string]rango_value{}
+	for name, value := range values {
+		saved[name] = rango_value{Type: rango_fmt.Sprintf("%T", value), Data: rango_encode(value)}
+	}
+	var buf rango_bytes.Buffer
+	if err := rango_gob.NewEncoder(&buf).Encode(saved); err == nil {
+		rango_ioutil.WriteFile(file, buf.Bytes(), 0644)
+	}
+}
+func rango_encode(value interface{}) (data []byte) {
+	if value == nil {
+		return nil
+	}
+	defer func() {
+		// gob panics on values such as nil pointers
+		if recover() != nil {
+			data = nil
+		}
+	}()
+	var buf rango_bytes.Buffer
+	if err := rango_gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil
+	}
+	decoded := rango_reflect.New(rango_reflect.TypeOf(value))
+	if err := rango_gob.NewDecoder(rango_bytes.NewReader(buf.Bytes())).DecodeValue(decoded); err != nil {
+		return nil
+	}
+	if rango_reflect.DeepEqual(value, decoded.Elem().Interface()) {
+		return buf.Bytes()
+	}
+	// values such as time.Time encode themselves ; accept if encoding the decoded value gives the same data
+	if _, ok := value.(rango_gob.GobEncoder); ok {
+		var again rango_bytes.Buffer
+		if err := rango_gob.NewEncoder(&again).Encode(decoded.Elem().Interface()); err == nil && rango_bytes.Equal(buf.Bytes(), again.Bytes()) {
+			return buf.Bytes()
+		}
+	}
+	return nil
+}
+func rango_restore(file string, pointers map[string]interface{}) {
+	data, err := rango_ioutil.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	saved := map[string]rango_value{}
+	if err := rango_gob.NewDecoder(rango_bytes.NewReader(data)).Decode(&saved); err != nil {
+		panic(err)
+	}
+	for name, pointer := range pointers {
+		if err := rango_gob.NewDecoder(rango_bytes.NewReader(saved[name].Data)).Decode(pointer); err != nil {
+			panic(err)
+		}
+	}
 }
-`
+{{end}}`
 }
@@ -0,0 +1,126 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// written by a Go program that received SIGQUIT, followed by the stacks of all its goroutines
+	quitDumpBegin = "SIGQUIT: quit"
+	// written by the Go runtime if no goroutine can proceed, followed by the stacks of all goroutines
+	deadlockDumpBegin = "fatal error: all goroutines are asleep - deadlock!"
+)
+
+var (
+	// matches the first line of a goroutine in a dump such as goroutine 7 gp=0xc0000 m=nil [chan send]:
+	goroutineHeader = regexp.MustCompile(`^goroutine (\d+) (?:[^\[]* )?\[(.*)\]:$`)
+	// matches the location of a frame, with or without frame pointers, such as /tmp/rango/generated_by_rango.go:20 +0xfb
+	frameLocation = regexp.MustCompile(`^\t(\S+\.go):(\d+)`)
+)
+
+// cutGoroutineDump separates the output of a program from the goroutine dump it wrote when stopped or deadlocked.
+// Return the output before the dump and the dump, if any.
+func cutGoroutineDump(output string) (string, string) {
+	for _, each := range []string{quitDumpBegin, deadlockDumpBegin} {
+		if begin := strings.Index(output, each); begin != -1 {
+			return output[:begin], output[begin:]
+		}
+	}
+	return output, ""
+}
+
+// isDumpBegin returns whether a line of output starts a goroutine dump
+func isDumpBegin(line string) bool {
+	return line == quitDumpBegin || line == deadlockDumpBegin
+}
+
+// isDeadlock returns whether a goroutine dump was written because no goroutine could proceed
+func isDeadlock(dump string) bool {
+	return strings.HasPrefix(dump, deadlockDumpBegin)
+}
+
+// summarizeGoroutines returns, per goroutine of a dump, its state and the frames that are in entries.
+// Frames of other code are named by their function ; frames of the runtime and of rango itself are left out,
+// as are goroutines without any other frame (unless debugging).
+func summarizeGoroutines(sourceLines []SourceHolder, dump string) string {
+	summary := []string{}
+	var goroutine []string // header and frames of the goroutine being read
+	function := ""         // function of the frame being read
+	end := func() {
+		if len(goroutine) > 1 || (len(goroutine) > 0 && *DEBUG) {
+			summary = append(summary, goroutine...)
+		}
+		goroutine = nil
+	}
+	for _, each := range strings.Split(dump, "\n") {
+		if match := goroutineHeader.FindStringSubmatch(each); match != nil {
+			end()
+			if match[1] != "0" {
+				// goroutine 0 is the scheduler of a thread
+				goroutine = []string{fmt.Sprintf("goroutine %s [%s]:", match[1], match[2])}
+			}
+			continue
+		}
+		if goroutine == nil {
+			continue
+		}
+		match := frameLocation.FindStringSubmatch(each)
+		if match == nil {
+			if strings.HasSuffix(each, ")") || strings.HasPrefix(each, "created by ") {
+				function = each
+			}
+			continue
+		}
+		inRuntime := isRuntimeFunction(strings.TrimPrefix(function, "created by "))
+		line, _ := strconv.Atoi(match[2])
+		frame := frameName(sourceLines, function, match[1], line)
+		// a goroutine is often created on the line of its function
+		shown := strings.Replace(frame, "created by ", "", 1)
+		if len(frame) > 0 && (!inRuntime || *DEBUG) && !containsName(goroutine, shown) {
+			goroutine = append(goroutine, frame)
+		}
+		function = ""
+	}
+	end()
+	return strings.Join(summary, "\n")
+}
+
+// isRuntimeFunction returns whether a function of a frame belongs to the Go runtime
+func isRuntimeFunction(function string) bool {
+	return strings.HasPrefix(function, "runtime.") ||
+		strings.HasPrefix(function, "internal/") ||
+		// e.g. sync.runtime_SemacquireWaitGroup
+		strings.Contains(function, ".runtime_")
+}
+
+// frameName returns how a frame of a goroutine is summarized ; empty if it is left out.
+// A frame in an entry is named by the entry and its source, other frames by their function.
+func frameName(sourceLines []SourceHolder, function, file string, line int) string {
+	if isScaffoldingFrame(function, file) && !*DEBUG {
+		return ""
+	}
+	created := strings.HasPrefix(function, "created by ")
+	name := "\t"
+	if created {
+		name += "created by "
+	}
+	if where, ok := locateFrame(sourceLines, file, line); ok {
+		return name + where.entry()
+	}
+	function = strings.TrimPrefix(function, "created by ")
+	if created {
+		// created by main.main in goroutine 1
+		function = strings.Split(function, " ")[0]
+	} else if open := strings.LastIndex(function, "("); open > 0 {
+		// without the arguments
+		function = function[:open]
+	}
+	return name + function
+}
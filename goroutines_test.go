@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+const quitDump = "SIGQUIT: quit\nPC=0x49a74a m=0 sigcode=0\n\n" +
+	"goroutine 1 gp=0xc0000 m=0 mp=0x57 [running]:\n" +
+	"main.main()\n\t/tmp/rango-1/generated_by_rango.go:20 +0xea fp=0xc0 sp=0xc0 pc=0x49\n" +
+	"runtime.main()\n\t/usr/local/go/src/runtime/proc.go:302 +0x427 fp=0xc0 sp=0xc0 pc=0x44\n\n" +
+	"goroutine 2 gp=0xc0001 m=nil [force gc (idle)]:\n" +
+	"runtime.forcegchelper()\n\t/usr/local/go/src/runtime/proc.go:387 +0xb3 fp=0xc0 sp=0xc0 pc=0x44\n" +
+	"created by runtime.init.7 in goroutine 1\n\t/usr/local/go/src/runtime/proc.go:375 +0x1a\n\n" +
+	"goroutine 7 gp=0xc0002 m=nil [sleep]:\n" +
+	"time.Sleep(0x34630b8a000)\n\t/usr/local/go/src/runtime/time.go:368 +0x165 fp=0xc0 sp=0xc0 pc=0x47\n" +
+	"main.main.func1()\n\t/tmp/rango-1/generated_by_rango.go:19 +0x1d fp=0xc0 sp=0xc0 pc=0x49\n" +
+	"created by main.main in goroutine 1\n\t/tmp/rango-1/generated_by_rango.go:19 +0xb3\n\n" +
+	"rax    0x2\nrbx    0x0\n"
+
+func TestSummarizeGoroutines(t *testing.T) {
+	holders := []SourceHolder{
+		{EntryCount: 1, Type: Statement, Source: "go func() { time.Sleep(time.Hour) }()", LineNumber: 19},
+		{EntryCount: 2, Type: Statement, Source: "for {}", LineNumber: 20}}
+	output, dump := cutGoroutineDump("\x00rango:2\x00waiting\n" + quitDump)
+	if output != "\x00rango:2\x00waiting\n" || isDeadlock(dump) {
+		t.Fatalf("output=%q", output)
+	}
+	expected := "goroutine 1 [running]:\n\tentry 2: for {}\n" +
+		"goroutine 7 [sleep]:\n\ttime.Sleep\n\tentry 1: go func() { time.Sleep(time.Hour) }()"
+	if summary := summarizeGoroutines(holders, dump); summary != expected {
+		t.Fatalf("summary=%q", summary)
+	}
+}
+
+func TestDeadlockOutput(t *testing.T) {
+	sourceLines = []SourceHolder{{EntryCount: 1, Type: Statement, Source: "<-ch", LineNumber: 14}}
+	stderr := "\x00rango:1\x00fatal error: all goroutines are asleep - deadlock!\n\n" +
+		"goroutine 1 [chan receive]:\nmain.main()\n\t/tmp/rango-1/generated_by_rango.go:14 +0x5d\nexit status 2\n"
+	result := Result{Kind: ExecutionError, Stdout: "\x00rango:1\x00", Stderr: stderr, ExitCode: 2}
+	expected := "[rango] entry 1 deadlocked: all goroutines are asleep\ngoroutine 1 [chan receive]:\n\tentry 1: <-ch"
+	if output := failureOutput(result, 1); output != expected {
+		t.Fatalf("output=%q", output)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// markUnusedImports records on each Import holder which of its packages are not used by the declarations and statements.
+// The generated source imports those for their side effects only (import _ "path") such that the compiler accepts them.
+// If the sources cannot be parsed then all imports are kept as entered.
+func markUnusedImports(imports, declarations, statements []*SourceHolder) {
+	for _, each := range imports {
+		each.UnusedImports = nil
+	}
+	qualifiers, err := ParseQualifiers(sourcesOf(declarations), sourcesOf(statements))
+	if err != nil {
+		return
+	}
+	var identifiers map[string]bool // parsed when a dot import is found
+	for _, each := range imports {
+		for i, spec := range each.Imports {
+			switch spec.Name {
+			case "_":
+				continue
+			case ".":
+				if identifiers == nil {
+					if identifiers, err = ParseIdentifiers(sourcesOf(declarations), sourcesOf(statements)); err != nil {
+						return
+					}
+				}
+				if !isDotImportUsed(spec.Path, identifiers) {
+					each.UnusedImports = append(each.UnusedImports, i)
+				}
+				continue
+			}
+			if !qualifiers[spec.Qualifier()] {
+				each.UnusedImports = append(each.UnusedImports, i)
+			}
+		}
+	}
+}
+
+// isDotImportUsed returns whether any of the names exported by a package is used unqualified.
+// If the package cannot be imported then it is taken as used ; the compiler reports why.
+func isDotImportUsed(importPath string, identifiers map[string]bool) bool {
+	pkg, err := importPackage(importPath)
+	if err != nil {
+		return true
+	}
+	for _, each := range pkg.Scope().Names() {
+		if token.IsExported(each) && identifiers[each] {
+			return true
+		}
+	}
+	return false
+}
+
+// importPackage type-checks a package as imported by the generated source ; packages are imported once per session
+func importPackage(importPath string) (*types.Package, error) {
+	// packages are imported from the directory which holds the go.mod of the session
+	dir := workspace
+	if len(packageDir) > 0 {
+		dir = packageDir
+	}
+	return sourceImporter.(types.ImporterFrom).ImportFrom(importPath, dir, 0)
+}
+
+// Qualifier returns the name by which entries refer to the package ; _ or . if not referred to by name
+func (s ImportSpec) Qualifier() string {
+	if len(s.Name) > 0 {
+		return s.Name
+	}
+	name := importName(s.Path)
+	if !token.IsIdentifier(name) {
+		// e.g. github.com/mattn/go-sqlite3 ; the package has another name
+		if pkg, err := importPackage(s.Path); err == nil {
+			return pkg.Name()
+		}
+	}
+	return name
+}
+
+// String returns the spec as written in an import declaration
+func (s ImportSpec) String() string {
+	if len(s.Name) > 0 {
+		return fmt.Sprintf("%s %q", s.Name, s.Path)
+	}
+	return strconv.Quote(s.Path)
+}
+
+// importSource returns the Go source of an import declaration of specs
+func importSource(specs []ImportSpec) string {
+	if len(specs) == 1 {
+		return "import " + specs[0].String()
+	}
+	written := []string{}
+	for _, each := range specs {
+		written = append(written, each.String())
+	}
+	return "import (" + strings.Join(written, "; ") + ")"
+}
+
+// sessionImport is a package imported by an entry
+type sessionImport struct {
+	ImportSpec
+	EntryCount int
+}
+
+// collectImports returns the imports of the entries in the order in which they were entered
+func collectImports(sourceLines []SourceHolder) []sessionImport {
+	imports := []sessionImport{}
+	for _, each := range sourceLines {
+		for _, spec := range each.Imports {
+			imports = append(imports, sessionImport{ImportSpec: spec, EntryCount: each.EntryCount})
+		}
+	}
+	return imports
+}
+
+// newImports returns the specs that the entries do not import yet ; a package imported again by the same name is left out,
+// as is a blank import of a package that is imported already.
+// Return an error if a spec gives a package a name that is already given to another package
+// or imports a package again by another name.
+func newImports(sourceLines []SourceHolder, specs []ImportSpec, entryCount int) ([]ImportSpec, error) {
+	known := collectImports(sourceLines)
+	added := []ImportSpec{}
+	for _, spec := range specs {
+		imported := false
+		for _, other := range known {
+			if other.Path == spec.Path && (spec.Name == "_" || other.Qualifier() == spec.Qualifier()) {
+				imported = true
+				break
+			}
+			if other.Path == spec.Path && other.Name != "_" {
+				return nil, fmt.Errorf("%q is already imported as %s (entry %d)", spec.Path, other.Qualifier(), other.EntryCount)
+			}
+			if name := spec.Qualifier(); name != "_" && name != "." && name == other.Qualifier() {
+				return nil, fmt.Errorf("%s is already the name of %q (entry %d)", name, other.Path, other.EntryCount)
+			}
+		}
+		if !imported {
+			known = append(known, sessionImport{ImportSpec: spec, EntryCount: entryCount})
+			added = append(added, spec)
+		}
+	}
+	return added, nil
+}
+
+// importUsers returns the entries that use an imported package
+func importUsers(sourceLines []SourceHolder, spec ImportSpec) []int {
+	users := []int{}
+	if spec.Name == "_" {
+		return users
+	}
+	for _, each := range sourceLines {
+		if Import == each.Type || each.Hidden || (len(users) > 0 && users[len(users)-1] == each.EntryCount) {
+			continue
+		}
+		declarations, statements := []string{}, []string{each.Source}
+		if Declaration == each.Type {
+			declarations, statements = statements, declarations
+		}
+		used := false
+		if spec.Name == "." {
+			identifiers, err := ParseIdentifiers(declarations, statements)
+			used = err == nil && isDotImportUsed(spec.Path, identifiers)
+		} else {
+			qualifiers, err := ParseQualifiers(declarations, statements)
+			used = err == nil && qualifiers[spec.Qualifier()]
+		}
+		if used {
+			users = append(users, each.EntryCount)
+		}
+	}
+	return users
+}
+
+// handleImports returns a table of the imports with the entries that use them (.imports)
+// or removes an import given by its name or path (.imports remove strings) ; the entries that still use it are reported.
+func handleImports(entry string) string {
+	fields := strings.Fields(entry)
+	if len(fields) > 1 {
+		if fields[1] != "remove" || len(fields) != 3 {
+			return "[rango] .imports [remove name|path]"
+		}
+		return removeImport(strings.Trim(fields[2], "\"`"))
+	}
+	imports := collectImports(sourceLines)
+	if len(imports) == 0 {
+		return "(no imports)"
+	}
+	var buf bytes.Buffer
+	table := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tPATH\tENTRY\tUSED BY")
+	for _, each := range imports {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\n", each.Qualifier(), each.Path, each.EntryCount, entryList(importUsers(sourceLines, each.ImportSpec)))
+	}
+	table.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// removeImport removes the import of a package by its name or else by its path.
+// The import declaration is written again without it ; an entry that imports nothing else is removed.
+func removeImport(nameOrPath string) string {
+	var found []sessionImport
+	for _, match := range []func(sessionImport) bool{
+		func(each sessionImport) bool { return each.Qualifier() == nameOrPath },
+		func(each sessionImport) bool { return each.Path == nameOrPath }} {
+		for _, each := range collectImports(sourceLines) {
+			if match(each) {
+				found = append(found, each)
+			}
+		}
+		if len(found) > 0 {
+			break
+		}
+	}
+	switch len(found) {
+	case 0:
+		return fmt.Sprintf("[rango] \"%s\": not imported", nameOrPath)
+	case 1:
+	default:
+		return fmt.Sprintf("[rango] \"%s\": imported more than once ; remove it by name", nameOrPath)
+	}
+	removed := found[0]
+	for i := range sourceLines {
+		holder := &sourceLines[i]
+		if holder.EntryCount != removed.EntryCount || Import != holder.Type {
+			continue
+		}
+		kept := []ImportSpec{}
+		for _, each := range holder.Imports {
+			if each != removed.ImportSpec {
+				kept = append(kept, each)
+			}
+		}
+		if len(kept) == len(holder.Imports) {
+			continue
+		}
+		if len(kept) == 0 {
+			sourceLines = append(sourceLines[:i], sourceLines[i+1:]...)
+		} else {
+			holder.Source, holder.Imports = importSource(kept), kept
+		}
+		break
+	}
+	if logChanges {
+		dumpChanges()
+	}
+	output := fmt.Sprintf("[rango] removed import %s", removed.ImportSpec)
+	if users := importUsers(sourceLines, removed.ImportSpec); len(users) > 0 {
+		output += fmt.Sprintf("\n[rango] warning: still used by entry %s", entryList(users))
+	}
+	return output
+}
+
+// entryList returns entry counts separated by commas
+func entryList(entryCounts []int) string {
+	written := []string{}
+	for _, each := range entryCounts {
+		written = append(written, strconv.Itoa(each))
+	}
+	return strings.Join(written, ", ")
+}
+
+// specName returns the name given to an imported package ; empty if it has none
+func specName(spec *ast.ImportSpec) string {
+	if spec.Name == nil {
+		return ""
+	}
+	return spec.Name.Name
+}
+
+// blankImports returns the source of import declarations in which the packages of the specs at the given indexes
+// are imported for their side effects only. The source keeps its lines.
+func blankImports(source string, indexes []int) string {
+	const prefix = "package p\n"
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", prefix+source, parser.ImportsOnly)
+	if err != nil {
+		return source
+	}
+	// from the last such that the offsets of the others are kept ; the indexes are in ascending order
+	for at := len(indexes) - 1; at >= 0; at-- {
+		if indexes[at] >= len(file.Imports) {
+			continue
+		}
+		each := file.Imports[indexes[at]]
+		begin, end := fset.Position(each.Pos()).Offset-len(prefix), fset.Position(each.Path.Pos()).Offset-len(prefix)
+		source = source[:begin] + "_ " + source[end:]
+	}
+	return source
+}
@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+func TestBlankImports(t *testing.T) {
+	source := "import (\n\ts \"strings\"\n\t\"os\"\n\t. \"math\"\n)"
+	if got, want := blankImports(source, []int{0, 2}), "import (\n\t_ \"strings\"\n\t\"os\"\n\t_ \"math\"\n)"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestMarkUnusedImports(t *testing.T) {
+	imports := []*SourceHolder{}
+	for _, each := range []string{`import "strings"`, `import (s "strings"; _ "embed"; "os")`, `import . "math"`, `import . "unicode/utf8"`} {
+		specs, err := ParseImports(each)
+		if err != nil {
+			t.Fatal(err)
+		}
+		holder := NewImport(1, each, specs)
+		imports = append(imports, &holder)
+	}
+	statements := []*SourceHolder{
+		{Type: Statement, Source: `println(s.ToUpper("a"), Sqrt(4), os.Args)`},
+		{Type: VariableDecl, Source: "x := 1", VariableNames: []string{"x"}}}
+	markUnusedImports(imports, nil, statements)
+	for i, want := range [][]int{{0}, nil, nil, {0}} {
+		if !equalInts(imports[i].UnusedImports, want) {
+			t.Fatalf("i=%d unused=%v", i, imports[i].UnusedImports)
+		}
+	}
+	if got := imports[0].Code(); got != `import _ "strings"` {
+		t.Fatalf("code=%q", got)
+	}
+}
+
+func TestBlankUses(t *testing.T) {
+	holder := NewVariableDecl(1, "x, _, y := f() // values", []string{"x", "_", "y"})
+	if got, want := holder.Code(), "x, _, y := f(); _ = x; _ = y // values"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got := holder.CodeEndColumn(); got != len("x, _, y := f()")+1 {
+		t.Fatal("column=", got)
+	}
+}
+
+func TestNewImports(t *testing.T) {
+	newSession(Result{})
+	dispatch(`import ("strings"; r "math/rand")`)
+	specs, _ := ParseImports(`import ("strings"; _ "strings"; . "math"; . "math")`)
+	added, err := newImports(sourceLines, specs, 2)
+	if err != nil || len(added) != 1 || added[0] != (ImportSpec{Name: ".", Path: "math"}) {
+		t.Fatalf("added=%v err=%v", added, err)
+	}
+	specs, _ = ParseImports(`import r "crypto/rand"`)
+	if _, err := newImports(sourceLines, specs, 2); err == nil || err.Error() != `r is already the name of "math/rand" (entry 1)` {
+		t.Fatal("err=", err)
+	}
+	specs, _ = ParseImports(`import str "strings"`)
+	if _, err := newImports(sourceLines, specs, 2); err == nil || err.Error() != `"strings" is already imported as strings (entry 1)` {
+		t.Fatal("err=", err)
+	}
+	if output := dispatch(`import ("os"; "strings")`); output != "" || sourceLines[1].Source != `import "os"` {
+		t.Fatalf("output=%q sourceLines=%v", output, sourceLines)
+	}
+}
+
+func TestRemoveImport(t *testing.T) {
+	newSession(Result{})
+	dispatch(`import ("os"; str "strings")`)
+	dispatch(`s := str.ToUpper("a")`)
+	if output := dispatch(".imports remove os"); output != `[rango] removed import "os"` {
+		t.Fatalf("output=%q", output)
+	}
+	if sourceLines[0].Source != `import str "strings"` || len(sourceLines[0].Imports) != 1 {
+		t.Fatalf("sourceLines=%v", sourceLines)
+	}
+	if output := dispatch(".imports remove str"); output != "[rango] removed import str \"strings\"\n[rango] warning: still used by entry 2" {
+		t.Fatalf("output=%q", output)
+	}
+	if Import == sourceLines[0].Type {
+		t.Fatalf("sourceLines=%v", sourceLines)
+	}
+	if output := dispatch(".imports"); output != "(no imports)" {
+		t.Fatalf("output=%q", output)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
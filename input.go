@@ -0,0 +1,250 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// file given by the .stdin command ; empty if programs read what is typed on the terminal
+	stdinFile string
+	// entryInputs holds the input given to each entry when it was the latest ; entries that are run again read it again
+	entryInputs = map[int][]byte{}
+	// latestInput holds the input given to the latest entry (or print) by the last run
+	latestInput []byte
+	// stdinRead holds how much of the file given by .stdin each entry read when it was the latest ; later runs continue after it
+	stdinRead = map[int]int{}
+)
+
+// the file read by a program as standard input if it does not read the terminal
+const inputFileName = "stdin"
+
+// programInput gives what is typed on the terminal to a running program.
+// First the input of the entries that are run again is written.
+type programInput struct {
+	writer   *os.File      // the standard input of the program
+	reader   *os.File      // the end of the pipe read by the program
+	closes   bool          // if true then the writer is closed once all input is given
+	terminal *os.File      // non-blocking duplicate of the terminal ; nil if it cannot be read
+	given    bytes.Buffer  // input given after the input of the entries that are run again
+	unread   []byte        // input given that the program did not read, e.g. typed ahead ; known once stopped
+	done     chan struct{} // closed when no more input is given
+}
+
+// readsTerminal returns whether programs read what is typed on the terminal ; otherwise they read an input file
+func readsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return len(stdinFile) == 0 && err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// forwardInput starts giving input to a program through the pipe of its standard input.
+// Unless closes is true, the writer is left open for a next run (e.g. of a plugin by the host).
+// Pending is input typed earlier that a previous run did not read ; it is given before what is typed now.
+func forwardInput(writer, reader *os.File, closes bool, replayed, pending []byte) *programInput {
+	input := &programInput{writer: writer, reader: reader, closes: closes, terminal: openTerminal(), done: make(chan struct{})}
+	go input.forward(replayed, pending)
+	return input
+}
+
+// forward writes the input until it ends or forwarding is stopped
+func (p *programInput) forward(replayed, pending []byte) {
+	defer close(p.done)
+	if p.closes {
+		// the program reads until the end of the input
+		defer p.writer.Close()
+	}
+	if _, err := p.writer.Write(replayed); err != nil {
+		return
+	}
+	p.given.Write(pending)
+	if _, err := p.writer.Write(pending); err != nil || p.terminal == nil {
+		return
+	}
+	buffer := make([]byte, 4096)
+	for {
+		// the terminal is in line mode ; Ctrl-D ends the input
+		n, err := p.terminal.Read(buffer)
+		if n > 0 {
+			p.given.Write(buffer[:n])
+			if _, err := p.writer.Write(buffer[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stop ends giving input once the program has stopped.
+// Return the input read by the program after the input of the entries that are run again.
+func (p *programInput) stop() []byte {
+	if p.terminal != nil {
+		p.terminal.SetReadDeadline(time.Now())
+	}
+	if !p.closes {
+		// the program may not read all input
+		p.writer.SetWriteDeadline(time.Now())
+	}
+	<-p.done
+	if p.terminal != nil {
+		p.terminal.Close()
+		// rango reads the terminal again
+		syscall.SetNonblock(0, false)
+	}
+	if !p.closes {
+		p.writer.SetWriteDeadline(time.Time{})
+	}
+	// input that the program did not read is taken back ; it is not recorded as given
+	unread := takeUnread(p.reader)
+	if len(unread) > p.given.Len() {
+		// part of the input of the entries that are run again
+		unread = unread[len(unread)-p.given.Len():]
+	}
+	p.unread = unread
+	p.given.Truncate(p.given.Len() - len(unread))
+	return p.given.Bytes()
+}
+
+// takeUnread reads what is left in a pipe without waiting for more
+func takeUnread(reader *os.File) []byte {
+	conn, err := reader.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	unread := []byte{}
+	buffer := make([]byte, 4096)
+	conn.Read(func(fd uintptr) bool {
+		// the pipe is shared with the program which reads it blocking ; a non-blocking read fails once it is empty
+		if syscall.SetNonblock(int(fd), true) != nil {
+			return true
+		}
+		defer syscall.SetNonblock(int(fd), false)
+		for {
+			n, err := syscall.Read(int(fd), buffer)
+			if n <= 0 || err != nil {
+				return true
+			}
+			unread = append(unread, buffer[:n]...)
+		}
+	})
+	return unread
+}
+
+// openTerminal returns a non-blocking duplicate of standard input, nil if that fails.
+// Unlike standard input itself, reading it can be stopped such that rango can read the next entry.
+func openTerminal() *os.File {
+	fd, err := syscall.Dup(0)
+	if err != nil {
+		return nil
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil
+	}
+	return os.NewFile(uintptr(fd), "terminal")
+}
+
+// writeInputFile writes the file read by a program that does not read the terminal.
+// It holds the input of the entries that are run again followed by the rest of the file given by .stdin, if any ;
+// what the entries read of it is part of their input already.
+func writeInputFile(replayed []byte) (string, error) {
+	input := append([]byte{}, replayed...)
+	if len(stdinFile) > 0 {
+		data, err := ioutil.ReadFile(stdinFile)
+		if err != nil {
+			return "", err
+		}
+		if offset := stdinOffset(); offset < len(data) {
+			input = append(input, data[offset:]...)
+		}
+	}
+	path := workspacePath(inputFileName)
+	return path, ioutil.WriteFile(path, input, 0644)
+}
+
+// inputGiven returns the part of an input file that was read by a program after the input of the entries that are run again.
+// The offset is how far the program read the file.
+func inputGiven(path string, replayed int, offset int64) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || offset <= int64(replayed) || offset > int64(len(data)) {
+		return nil
+	}
+	return data[replayed:offset]
+}
+
+// replayedInput returns the input given earlier to the entries that are run again by the program.
+// No input is recorded yet for the latest entry (or print) ; it reads new input.
+func replayedInput(imageVars templateVars) []byte {
+	var input bytes.Buffer
+	replayed := map[int]bool{}
+	for _, each := range imageVars.Statements {
+		if Print == each.Type || replayed[each.EntryCount] {
+			continue
+		}
+		replayed[each.EntryCount] = true
+		input.Write(entryInputs[each.EntryCount])
+	}
+	return input.Bytes()
+}
+
+// recordInput keeps the input given to the latest entry ; it is given again when the entry is run again
+func recordInput(entryCount int) {
+	entryInputs[entryCount] = latestInput
+	if len(stdinFile) > 0 {
+		stdinRead[entryCount] = len(latestInput)
+	}
+}
+
+// stdinOffset returns how much of the file given by .stdin the entries have read
+func stdinOffset() int {
+	offset := 0
+	for _, each := range stdinRead {
+		offset += each
+	}
+	return offset
+}
+
+// forgetInputs removes the recorded input of all entries starting at a given entry count
+func forgetInputs(from int) {
+	for count := range entryInputs {
+		if count >= from {
+			delete(entryInputs, count)
+		}
+	}
+	for count := range stdinRead {
+		if count >= from {
+			delete(stdinRead, count)
+		}
+	}
+}
+
+// handleStdin shows or changes what programs read on standard input (.stdin [file|-]).
+// Each run reads the file after the input of the entries that are run again ; - restores the terminal.
+func handleStdin(entry string) string {
+	fields := strings.Fields(entry)
+	if len(fields) > 1 {
+		// a file is read from its start
+		stdinRead = map[int]int{}
+		if fields[1] == "-" {
+			stdinFile = ""
+		} else if info, err := os.Stat(fields[1]); err != nil || info.IsDir() {
+			return fmt.Sprintf("[rango] \"%s\": not a file", fields[1])
+		} else {
+			stdinFile = fields[1]
+		}
+	}
+	if len(stdinFile) == 0 {
+		return "[rango] stdin is the terminal"
+	}
+	return fmt.Sprintf("[rango] stdin is read from %s", stdinFile)
+}
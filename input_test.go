@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleStdin(t *testing.T) {
+	defer func() { stdinFile = "" }()
+	file := filepath.Join(t.TempDir(), "input.txt")
+	ioutil.WriteFile(file, []byte("42\n"), 0644)
+	if output := handleStdin(".stdin " + file); output != "[rango] stdin is read from "+file {
+		t.Fatalf("output=%q", output)
+	}
+	if output := handleStdin(".stdin /no/such/file"); output != "[rango] \"/no/such/file\": not a file" || stdinFile != file {
+		t.Fatalf("output=%q file=%q", output, stdinFile)
+	}
+	if output := handleStdin(".stdin -"); output != "[rango] stdin is the terminal" {
+		t.Fatalf("output=%q", output)
+	}
+}
+
+func TestRunCommandInputFile(t *testing.T) {
+	dir := t.TempDir()
+	defer func(was string) { workspace, stdinFile, latestInput = was, "", nil }(workspace)
+	workspace, stdinFile = dir, filepath.Join(dir, "input.txt")
+	ioutil.WriteFile(stdinFile, []byte("x y\n"), 0644)
+	// the replayed input comes first ; only what is read after it is given to the latest entry
+	stdout, _, err := runCommand(exec.Command("cat"), true, []byte("first\n"))
+	if err != nil || stdout != "first\nx y\n" {
+		t.Fatalf("err=%v stdout=%q", err, stdout)
+	}
+	if string(latestInput) != "x y\n" {
+		t.Fatalf("input=%q", latestInput)
+	}
+	// a program that does not read its input is given none
+	if _, _, err := runCommand(exec.Command("true"), true, nil); err != nil || latestInput != nil {
+		t.Fatalf("err=%v input=%q", err, latestInput)
+	}
+}
+
+func TestReplayedInput(t *testing.T) {
+	defer forgetInputs(1)
+	entryInputs[1], entryInputs[3] = []byte("a\n"), []byte("b\n")
+	first, again, second, printed := NewStatement(1, "a := 1"), NewStatement(1, "b := 2"), NewStatement(2, "c := 3"), NewPrint(3, "a")
+	imageVars := templateVars{Statements: []*SourceHolder{&first, &again, &second, &printed}}
+	if input := string(replayedInput(imageVars)); input != "a\n" {
+		t.Fatalf("input=%q", input)
+	}
+}
+
+func TestWriteInputFileContinues(t *testing.T) {
+	dir := t.TempDir()
+	defer func(was string) { workspace, stdinFile, latestInput = was, "", nil; forgetInputs(1) }(workspace)
+	workspace, stdinFile = dir, filepath.Join(dir, "input.txt")
+	ioutil.WriteFile(stdinFile, []byte("a\nb\n"), 0644)
+	// entry 1 read the first line ; it reads it again when it is run again
+	latestInput = []byte("a\n")
+	recordInput(1)
+	path, err := writeInputFile(entryInputs[1])
+	if data, _ := ioutil.ReadFile(path); err != nil || string(data) != "a\nb\n" {
+		t.Fatalf("err=%v data=%q", err, data)
+	}
+}
+
+func TestForwardInputUnread(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	defer writer.Close()
+	input := forwardInput(writer, reader, false, nil, []byte("typed\nahead\n"))
+	line := make([]byte, 6)
+	if _, err := io.ReadFull(reader, line); err != nil {
+		t.Fatal(err)
+	}
+	// the program read one line only
+	if given := string(input.stop()); given != "typed\n" || string(input.unread) != "ahead\n" {
+		t.Fatalf("given=%q unread=%q", given, input.unread)
+	}
+}
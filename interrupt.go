@@ -0,0 +1,116 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how long a stopped program gets to write the stacks of its goroutines
+const quitTimeout = 2 * time.Second
+
+var (
+	// timeout option ; changed by the .timeout command
+	Timeout = flag.Duration("timeout", 0, "stop a program that runs longer than this duration (e.g. 5s) ; 0 means no limit")
+	// receives Ctrl-C (SIGINT) while rango is running ; nil if not watched
+	interrupts chan os.Signal
+)
+
+// stopError is the reason why rango stopped a running process group
+type stopError string
+
+func (e stopError) Error() string {
+	return string(e)
+}
+
+// watchInterrupts makes Ctrl-C stop the running program instead of rango.
+// Programs run in their own process group such that they do not receive the signal themselves.
+func watchInterrupts() {
+	interrupts = make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+}
+
+// clearInterrupts forgets a Ctrl-C that was pressed while no program was running
+func clearInterrupts() {
+	select {
+	case <-interrupts:
+	default:
+	}
+}
+
+// newProcessGroup returns the attributes to start a process as the leader of a new process group
+func newProcessGroup() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// waitProcessGroup waits for the outcome of a process started in a new process group.
+// The group is killed if Ctrl-C is pressed ; a generated program is also stopped if the timeout (if positive) expires.
+// A generated program is first asked to quit such that it writes the stacks of its goroutines ; the outcome is always awaited.
+func waitProcessGroup(pid int, done <-chan error, program bool) error {
+	var expired <-chan time.Time
+	if timeout := *Timeout; program && timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var stopped stopError
+	select {
+	case err := <-done:
+		return err
+	case <-interrupts:
+		stopped = "interrupted"
+	case <-expired:
+		stopped = stopError(fmt.Sprintf("timed out after %v", *Timeout))
+	}
+	if program && quit(pid, done) {
+		// the group can hold processes started by the program
+		syscall.Kill(-pid, syscall.SIGKILL)
+		return stopped
+	}
+	syscall.Kill(-pid, syscall.SIGKILL)
+	<-done
+	return stopped
+}
+
+// quit sends SIGQUIT to a Go program which then writes the stacks of its goroutines and exits.
+// Return whether it did so within quitTimeout ; Ctrl-C stops waiting.
+func quit(pid int, done <-chan error) bool {
+	syscall.Kill(pid, syscall.SIGQUIT)
+	timer := time.NewTimer(quitTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-interrupts:
+	case <-timer.C:
+	}
+	return false
+}
+
+// handleTimeout shows or changes the timeout of running programs (.timeout [duration]).
+// A duration of 0 or off removes the timeout.
+func handleTimeout(entry string) string {
+	fields := strings.Fields(entry)
+	if len(fields) > 1 {
+		if fields[1] == "off" {
+			fields[1] = "0"
+		}
+		timeout, err := time.ParseDuration(fields[1])
+		if err != nil || timeout < 0 {
+			return fmt.Sprintf("[rango] \"%s\": not a duration", fields[1])
+		}
+		*Timeout = timeout
+	}
+	if *Timeout == 0 {
+		return "[rango] no timeout"
+	}
+	return fmt.Sprintf("[rango] timeout is %v", *Timeout)
+}
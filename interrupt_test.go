@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestHandleTimeout(t *testing.T) {
+	defer func() { *Timeout = 0 }()
+	if output := handleTimeout(".timeout 5s"); output != "[rango] timeout is 5s" {
+		t.Fatalf("output=%q", output)
+	}
+	if output := handleTimeout(".timeout soon"); output != "[rango] \"soon\": not a duration" || *Timeout != 5*time.Second {
+		t.Fatalf("output=%q timeout=%v", output, *Timeout)
+	}
+	if output := handleTimeout(".timeout off"); output != "[rango] no timeout" {
+		t.Fatalf("output=%q", output)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	*Timeout = 200 * time.Millisecond
+	defer func() { *Timeout = 0 }()
+	// the shell starts sleep in the same process group
+	start := time.Now()
+	stdout, _, err := runCommand(exec.Command("sh", "-c", "echo started; sleep 10; echo done"), true, nil)
+	if _, stopped := err.(stopError); !stopped || stdout != "started\n" {
+		t.Fatalf("err=%v stdout=%q", err, stdout)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("process group not killed")
+	}
+	result := Result{Kind: ExecutionError, Err: err, Stdout: "\x00rango:1\x00started\n", ExitCode: exitCode(err)}
+	if output := failureOutput(result, 1); output != "started\n[rango] entry 1 timed out after 200ms" {
+		t.Fatalf("output=%q", output)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// limits holds the resource limits of programs ; a zero value means no limit
+type limits struct {
+	Memory int64         // bytes of data (heap) the program can allocate
+	CPU    time.Duration // processor time the program can use
+	Files  int           // files the program can have open at once
+}
+
+var (
+	// limit option ; the limits are changed by the .limit command
+	Limit = flag.String("limit", "", "limit the resources of programs, e.g. mem=512M,cpu=10s,files=256")
+	// the resource limits of programs
+	programLimits limits
+	// matches the fatal error of the Go runtime when it cannot allocate memory, e.g. fatal error: runtime: out of memory
+	outOfMemory = regexp.MustCompile(`fatal error: .*(out of memory|cannot allocate memory)`)
+	// the sizes of memory by their suffix
+	memoryUnits = map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+)
+
+// with returns the limits changed by settings such as mem=512M ; a value of 0 removes that limit
+func (l limits) with(settings []string) (limits, error) {
+	for _, each := range settings {
+		nameValue := strings.SplitN(each, "=", 2)
+		if len(nameValue) != 2 {
+			return l, fmt.Errorf("\"%s\": not a limit (mem=, cpu= or files=)", each)
+		}
+		var err error
+		switch value := nameValue[1]; nameValue[0] {
+		case "mem":
+			l.Memory, err = parseMemory(value)
+		case "cpu":
+			l.CPU, err = time.ParseDuration(value)
+			if err == nil && l.CPU < 0 {
+				err = errors.New("negative")
+			}
+		case "files":
+			l.Files, err = strconv.Atoi(value)
+			if err == nil && l.Files < 0 {
+				err = errors.New("negative")
+			}
+		default:
+			return l, fmt.Errorf("\"%s\": unknown limit (mem, cpu or files)", nameValue[0])
+		}
+		if err != nil {
+			return l, fmt.Errorf("\"%s\": invalid %s limit", nameValue[1], nameValue[0])
+		}
+	}
+	return l, nil
+}
+
+// limitSettings returns the settings such as mem=512M separated by spaces or commas
+func limitSettings(settings string) []string {
+	return strings.Fields(strings.Replace(settings, ",", " ", -1))
+}
+
+// parseMemory returns the number of bytes of a size such as 512M, 1G or 65536
+func parseMemory(size string) (int64, error) {
+	unit := int64(1)
+	if len(size) > 0 {
+		if each, ok := memoryUnits[strings.ToUpper(size[len(size)-1:])]; ok {
+			unit, size = each, size[:len(size)-1]
+		}
+	}
+	count, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || count < 0 {
+		return 0, errors.New("not a size")
+	}
+	return count * unit, nil
+}
+
+// formatMemory returns a number of bytes using the largest suffix that divides it
+func formatMemory(bytes int64) string {
+	for _, each := range []string{"G", "M", "K"} {
+		if unit := memoryUnits[each]; bytes%unit == 0 {
+			return fmt.Sprintf("%d%s", bytes/unit, each)
+		}
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+func (l limits) String() string {
+	settings := []string{}
+	if l.Memory > 0 {
+		settings = append(settings, "mem="+formatMemory(l.Memory))
+	}
+	if l.CPU > 0 {
+		settings = append(settings, fmt.Sprintf("cpu=%v", l.CPU))
+	}
+	if l.Files > 0 {
+		settings = append(settings, fmt.Sprintf("files=%d", l.Files))
+	}
+	return strings.Join(settings, " ")
+}
+
+// programCommand returns the command that runs a program within the limits.
+// The shell sets the limits (setrlimit) and then replaces itself by the program ; it keeps the process id.
+func programCommand(executable string, l limits, args ...string) *exec.Cmd {
+	ulimits := []string{}
+	if l.Memory > 0 {
+		// the data segment includes the heap ; the address space is not limited because the Go runtime reserves much more than it uses
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -d %d", (l.Memory+1023)/1024))
+	}
+	if l.CPU > 0 {
+		// in whole seconds ; the kernel kills the program when they are used
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -t %d", int64((l.CPU+time.Second-1)/time.Second)))
+	}
+	if l.Files > 0 {
+		// both soft and hard such that the Go runtime cannot raise it
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -n %d", l.Files))
+	}
+	if len(ulimits) == 0 {
+		return exec.Command(executable, args...)
+	}
+	cmd := exec.Command("/bin/sh", append([]string{"-c", strings.Join(ulimits, " && ") + ` && exec "$0" "$@"`, executable}, args...)...)
+	if l.Memory > 0 {
+		// the garbage collector works harder before the limit is reached
+		cmd.Env = append(os.Environ(), fmt.Sprintf("GOMEMLIMIT=%d", l.Memory))
+	}
+	return cmd
+}
+
+// exceededLimit returns the name of the limit that stopped a program, empty if none did.
+// A program that exceeds the memory limit fails to allocate ; the kernel kills a program that exceeds the cpu limit.
+func exceededLimit(result Result, l limits) string {
+	if l.Memory > 0 && outOfMemory.MatchString(result.Stdout+result.Stderr) {
+		return "memory"
+	}
+	if l.CPU > 0 && result.Signal == syscall.SIGKILL {
+		return "cpu"
+	}
+	return ""
+}
+
+// cutOutOfMemory removes the fatal error of the Go runtime with its stacks from the output of a program that exceeded the memory limit
+func cutOutOfMemory(output string) string {
+	if location := outOfMemory.FindStringIndex(output); location != nil {
+		return output[:location[0]]
+	}
+	return output
+}
+
+// handleLimit shows or changes the resource limits of programs (.limit [mem=512M] [cpu=10s] [files=256] | .limit off).
+// A value of 0 removes a limit ; off removes all limits.
+func handleLimit(entry string) string {
+	fields := limitSettings(entry)[1:]
+	if len(fields) == 1 && fields[0] == "off" {
+		programLimits = limits{}
+	} else if changed, err := programLimits.with(fields); err != nil {
+		return "[rango] " + err.Error()
+	} else {
+		programLimits = changed
+	}
+	if programLimits == (limits{}) {
+		return "[rango] no limits"
+	}
+	return "[rango] limits are " + programLimits.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleLimit(t *testing.T) {
+	defer func() { programLimits = limits{} }()
+	if output := handleLimit(".limit mem=512M cpu=10s,files=256"); output != "[rango] limits are mem=512M cpu=10s files=256" {
+		t.Fatalf("output=%q", output)
+	}
+	if programLimits.Memory != 512<<20 || programLimits.CPU != 10*time.Second || programLimits.Files != 256 {
+		t.Fatalf("limits=%#v", programLimits)
+	}
+	if output := handleLimit(".limit mem=lots"); output != "[rango] \"lots\": invalid mem limit" || programLimits.Memory != 512<<20 {
+		t.Fatalf("output=%q", output)
+	}
+	if output := handleLimit(".limit disk=1G"); output != "[rango] \"disk\": unknown limit (mem, cpu or files)" {
+		t.Fatalf("output=%q", output)
+	}
+	if output := handleLimit(".limit cpu=0"); output != "[rango] limits are mem=512M files=256" {
+		t.Fatalf("output=%q", output)
+	}
+	if output := handleLimit(".limit off"); output != "[rango] no limits" {
+		t.Fatalf("output=%q", output)
+	}
+}
+
+func TestProgramCommand(t *testing.T) {
+	if cmd := programCommand("/tmp/program", limits{}); len(cmd.Args) != 1 {
+		t.Fatalf("args=%v", cmd.Args)
+	}
+	cmd := programCommand("/tmp/program", limits{Memory: 1 << 30, CPU: 1500 * time.Millisecond})
+	if script := cmd.Args[2]; script != `ulimit -d 1048576 && ulimit -t 2 && exec "$0" "$@"` || cmd.Args[3] != "/tmp/program" {
+		t.Fatalf("args=%v", cmd.Args)
+	}
+	if env := strings.Join(cmd.Env, " "); !strings.Contains(env, "GOMEMLIMIT=1073741824") {
+		t.Fatal("no GOMEMLIMIT")
+	}
+}
+
+func TestExceededLimitOutput(t *testing.T) {
+	defer func() { programLimits = limits{} }()
+	programLimits = limits{Memory: 64 << 20, CPU: time.Second}
+	result := Result{Kind: ExecutionError, ExitCode: 2,
+		Stdout: "\x00rango:1\x00\x00rango:2\x00started\n",
+		Stderr: "fatal error: runtime: out of memory\n\nruntime stack:\nruntime.throw(...)\n\ngoroutine 1 [running]:\n"}
+	if output := failureOutput(result, 2); output != "started\n[rango] killed: exceeded memory limit at entry 2" {
+		t.Fatalf("output=%q", output)
+	}
+	result = Result{Kind: ExecutionError, ExitCode: -1, Signal: syscall.SIGKILL, Stdout: "\x00rango:1\x00"}
+	if output := failureOutput(result, 1); output != "[rango] killed: exceeded cpu limit at entry 1" {
+		t.Fatalf("output=%q", output)
+	}
+	programLimits = limits{}
+	if output := failureOutput(result, 1); output != "[rango] entry 1 killed by signal killed" {
+		t.Fatalf("output=%q", output)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// the module path of the programs of a session
+const sessionModule = "rango_session"
+
+var (
+	// counts the changes of the go.mod of the session ; a plugin host is restarted for a change
+	moduleChanges int
+	// matches the language version in the version of the go tool such as go1.22.3 or devel go1.23-3f8a3e4
+	goVersion = regexp.MustCompile(`go(\d+\.\d+(\.\d+)?)`)
+)
+
+// openModule writes the go.mod of the session workspace.
+// Modules are only resolved from the local module cache ; this also applies to type checking which runs go list.
+func openModule() error {
+	os.Setenv("GOPROXY", "off")
+	if flags := os.Getenv("GOFLAGS"); !strings.Contains(flags, "-mod=") {
+		// requirements are added to go.mod and go.sum while building
+		os.Setenv("GOFLAGS", strings.TrimSpace(flags+" -mod=mod"))
+	}
+	module := fmt.Sprintf("module %s\n", sessionModule)
+	if version, err := exec.Command("go", "env", "GOVERSION").Output(); err == nil {
+		if match := goVersion.FindSubmatch(version); match != nil {
+			// the language version of the go tool, as for a file built without go.mod
+			module += fmt.Sprintf("\ngo %s\n", match[1])
+		}
+	}
+	return ioutil.WriteFile(workspacePath("go.mod"), []byte(module), 0644)
+}
+
+// goCommand returns a command of the go tool that runs in the workspace such that it uses the go.mod of the session.
+// Inside a package it runs in the package directory.
+func goCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = workspace
+	if len(packageDir) > 0 {
+		cmd.Dir = packageDir
+	}
+	return cmd
+}
+
+// handleRequire shows the requirements of the session or changes them (.require module@version).
+// The version must be in the local module cache ; module@none removes the requirement.
+func handleRequire(entry string) string {
+	if len(packageName) > 0 {
+		return packageModuleUsed()
+	}
+	fields := strings.Fields(entry)
+	if len(fields) == 1 {
+		return moduleRequirements()
+	}
+	if !strings.Contains(fields[1], "@") {
+		return fmt.Sprintf("[rango] \"%s\": not module@version", fields[1])
+	}
+	return changeModule(goCommand("get", fields[1]))
+}
+
+// handleReplace points a module at a local directory (.replace path=>dir) ; .replace path removes the replacement.
+// The directory must hold a go.mod ; the module no longer needs to be required.
+func handleReplace(entry string) string {
+	if len(packageName) > 0 {
+		return packageModuleUsed()
+	}
+	pathDir := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(entry, ".replace")), "=>", 2)
+	path := strings.TrimSpace(pathDir[0])
+	if len(path) == 0 {
+		return moduleRequirements()
+	}
+	if len(pathDir) == 1 {
+		return changeModule(goCommand("mod", "edit", "-dropreplace", path))
+	}
+	dir, err := filepath.Abs(strings.TrimSpace(pathDir[1]))
+	if err != nil {
+		return fmt.Sprintf("[rango] %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+		return fmt.Sprintf("[rango] \"%s\": not a module directory", dir)
+	}
+	return changeModule(goCommand("mod", "edit", "-replace", path+"="+dir))
+}
+
+// packageModuleUsed returns why the session has no go.mod of its own
+func packageModuleUsed() string {
+	return fmt.Sprintf("[rango] entries are part of package %s ; its go.mod is used", packageName)
+}
+
+// changeModule runs the go tool to change the go.mod of the session.
+// Return the requirements of the session or the reason why the change failed.
+func changeModule(cmd *exec.Cmd) string {
+	if workspace == "." {
+		return "[rango] no session workspace"
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "[rango] " + strings.TrimSpace(string(output))
+	}
+	moduleChanges++
+	return moduleRequirements()
+}
+
+// moduleRequirements returns the require and replace directives of the go.mod of the session
+func moduleRequirements() string {
+	data, err := ioutil.ReadFile(workspacePath("go.mod"))
+	if err != nil {
+		return "[rango] no session go.mod"
+	}
+	directives := []string{}
+	for _, each := range strings.Split(string(data), "\n") {
+		if len(strings.TrimSpace(each)) == 0 || strings.HasPrefix(each, "module ") || strings.HasPrefix(each, "go ") || strings.HasPrefix(each, "toolchain ") {
+			continue
+		}
+		directives = append(directives, each)
+	}
+	if len(directives) == 0 {
+		return "[rango] no requirements"
+	}
+	return strings.Join(directives, "\n")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandleReplace(t *testing.T) {
+	t.Setenv("GOPROXY", os.Getenv("GOPROXY"))
+	t.Setenv("GOFLAGS", os.Getenv("GOFLAGS"))
+	defer func(was string) { workspace = was }(workspace)
+	workspace = t.TempDir()
+	if err := openModule(); err != nil {
+		t.Fatal(err)
+	}
+	lib := t.TempDir()
+	ioutil.WriteFile(filepath.Join(lib, "go.mod"), []byte("module example.com/lib\n"), 0644)
+	changes := moduleChanges
+	if output := handleReplace(".replace example.com/lib=>" + lib); output != "replace example.com/lib => "+lib || moduleChanges != changes+1 {
+		t.Fatalf("output=%q", output)
+	}
+	if output := handleReplace(".replace example.com/lib => " + workspace + "/none"); !strings.HasSuffix(output, "none\": not a module directory") {
+		t.Fatalf("output=%q", output)
+	}
+	if output := handleRequire(".require example.com/lib"); output != "[rango] \"example.com/lib\": not module@version" {
+		t.Fatalf("output=%q", output)
+	}
+	if output := handleReplace(".replace example.com/lib"); output != "[rango] no requirements" {
+		t.Fatalf("output=%q", output)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// The generated program writes a mark before the output of each entry
+	outputMarkBegin = "\x00rango:"
+	outputMarkEnd   = "\x00"
+	// The output of the Print holder of the last entry is marked separately
+	printOutputMark = -1
+)
+
+// entryOutputs holds the captured output per entry of the last successful run
+var entryOutputs = map[int]string{}
+
+// splitOutput separates the captured output of the generated program using the marks written by rango_mark.
+// Return the output per mark and the mark of the section that was written last.
+func splitOutput(output string) (map[int]string, int) {
+	sections := map[int]string{}
+	mark := 0
+	rest := output
+	for {
+		begin := strings.Index(rest, outputMarkBegin)
+		if begin == -1 {
+			sections[mark] += rest
+			break
+		}
+		sections[mark] += rest[:begin]
+		rest = rest[begin+len(outputMarkBegin):]
+		end := strings.Index(rest, outputMarkEnd)
+		if end == -1 {
+			// incomplete mark, keep it as output
+			sections[mark] += outputMarkBegin + rest
+			break
+		}
+		next, err := strconv.Atoi(rest[:end])
+		if err == nil {
+			mark = next
+		}
+		rest = rest[end+len(outputMarkEnd):]
+	}
+	return sections, mark
+}
+
+// splitResult separates both captured streams of a Result by entry.
+// Per entry, the output on standard error follows the output on standard output.
+func splitResult(result Result) (map[int]string, int) {
+	sections, last := splitOutput(result.Stdout)
+	errors, _ := splitOutput(result.Stderr)
+	for mark, each := range errors {
+		sections[mark] += each
+	}
+	return sections, last
+}
+
+// latestOutput returns the output of the latest entry (or print) of a successful evaluation
+func latestOutput(result Result, latest int) string {
+	sections, _ := splitResult(result)
+	if latest == printOutputMark {
+		return sections[printOutputMark]
+	}
+	return sections[latest] + sections[printOutputMark]
+}
+
+// unshownOutput returns the output unless it was already shown while the program ran
+func unshownOutput(result Result, output string) string {
+	if result.Shown {
+		return ""
+	}
+	return output
+}
+
+// failureOutput returns the reason why the evaluation of the latest entry (or print) failed.
+// Output that was already shown while the program ran is left out.
+func failureOutput(result Result, latest int) string {
+	switch result.Kind {
+	case CompilationError:
+		if stopped, ok := result.Err.(stopError); ok {
+			return fmt.Sprintf("[rango] build %s", stopped)
+		}
+		return prepareCompilerErrorOutput(result.Diagnostics)
+	case ExecutionError:
+		exceeded := exceededLimit(result, programLimits)
+		if exceeded == "memory" && !*DEBUG {
+			// the stacks of the runtime do not explain it
+			result.Stdout, result.Stderr = cutOutOfMemory(result.Stdout), cutOutOfMemory(result.Stderr)
+		}
+		panicked := strings.Contains(result.Stdout+result.Stderr, "goroutine ")
+		// the goroutine dump of a stopped or deadlocked program is summarized instead
+		stdout, stdoutDump := cutGoroutineDump(result.Stdout)
+		stderr, stderrDump := cutGoroutineDump(result.Stderr)
+		result.Stdout, result.Stderr = stdout, stderr
+		dump := stdoutDump + stderrDump
+		sections, last := splitResult(result)
+		if result.Shown {
+			delete(sections, latest)
+			delete(sections, printOutputMark)
+		}
+		output := failedOutput(sections, last, latest)
+		if last != 0 {
+			// messages written before any entry
+			output += sections[0]
+		}
+		output = translateTrace(sourceLines, output)
+		// a panic explains itself, an exit (e.g. os.Exit, log.Fatal) or a stop by rango does not
+		message := ""
+		if stopped, ok := result.Err.(stopError); ok {
+			message = fmt.Sprintf("[rango] %s %s", markName(last, latest), stopped)
+		} else if len(exceeded) > 0 {
+			message = fmt.Sprintf("[rango] killed: exceeded %s limit at %s", exceeded, markName(last, latest))
+		} else if result.Signal != 0 {
+			message = fmt.Sprintf("[rango] %s killed by signal %v", markName(last, latest), result.Signal)
+		} else if isDeadlock(dump) {
+			message = fmt.Sprintf("[rango] %s deadlocked: all goroutines are asleep", markName(last, latest))
+		} else if !panicked && result.ExitCode > 0 {
+			message = fmt.Sprintf("[rango] %s exited with status %d", markName(last, latest), result.ExitCode)
+		}
+		if goroutines := summarizeGoroutines(sourceLines, dump); len(goroutines) > 0 {
+			message += "\n" + goroutines
+		}
+		if len(message) > 0 {
+			if len(output) > 0 && !strings.HasSuffix(output, "\n") {
+				output += "\n"
+			}
+			output += message
+		}
+		return output
+	}
+	return result.Stderr
+}
+
+// markName returns how to refer to the section of a mark in messages
+func markName(mark, latest int) string {
+	if mark == printOutputMark || (mark == 0 && latest == printOutputMark) {
+		return "print"
+	}
+	if mark == 0 {
+		return fmt.Sprintf("entry %d", latest)
+	}
+	return fmt.Sprintf("entry %d", mark)
+}
+
+// forgetOutputs removes the recorded output of all entries starting at a given entry count
+func forgetOutputs(from int) {
+	for mark := range entryOutputs {
+		if mark >= from {
+			delete(entryOutputs, mark)
+		}
+	}
+}
+
+// failedOutput returns the output of the section in which the generated program stopped.
+// If that section belongs to an earlier entry than the latest then this is reported too.
+func failedOutput(sections map[int]string, last, latest int) string {
+	if last == printOutputMark && latest == printOutputMark {
+		return sections[printOutputMark]
+	}
+	if last == printOutputMark || last == latest {
+		return sections[latest] + sections[printOutputMark]
+	}
+	return fmt.Sprintf("[rango] failed at entry %d\n%s", last, sections[last])
+}
+
+// handleShowOutput returns the output recorded for the entry given in the command (.out N).
+// Without a number, the output of the latest entry is returned.
+func handleShowOutput(entry string) string {
+	fields := strings.Fields(entry)
+	count := entryCount
+	if len(fields) > 1 {
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Sprintf("[rango] \"%s\": not an entry number", fields[1])
+		}
+		count = n
+	}
+	output, ok := entryOutputs[count]
+	if !ok {
+		return fmt.Sprintf("[rango] no output recorded for entry %d", count)
+	}
+	return output
+}
+
+// live shows the output of a running program on the terminal ; nil if the output is only returned
+var live *liveOutput
+
+// label of each line written by a program on standard error
+const stderrLabel = "[stderr] "
+
+// liveOutput shows the output of a running program while it is written.
+// Only the output of the latest entry and of its print is shown.
+// Output on standard error is shown per line, labelled and with its stack traces translated.
+type liveOutput struct {
+	out     io.Writer
+	latest  int
+	mutex   sync.Mutex // standard output and standard error are written concurrently
+	streams []*liveStream
+	written bool // true if any output was shown for the current program
+	newline bool // true if the output shown ends with a newline
+}
+
+// liveStream writes one output stream of a program to its liveOutput
+type liveStream struct {
+	live     *liveOutput
+	labelled bool
+	mark     int    // mark of the section being written
+	buffer   []byte // output that can be the start of a mark
+	line     []byte // incomplete line if labelled
+	trace    *traceTranslator
+	dumped   bool // true once a goroutine dump started ; it is summarized when the program has stopped
+}
+
+func newLiveOutput(out io.Writer) *liveOutput {
+	return &liveOutput{out: out}
+}
+
+// show sets the mark of the latest entry (or print) of the program to run next
+func (l *liveOutput) show(latest int) {
+	l.latest = latest
+}
+
+// writers returns the writers for standard output and standard error of the program to run next
+func (l *liveOutput) writers() (io.Writer, io.Writer) {
+	l.written, l.newline = false, true
+	stdout := &liveStream{live: l}
+	stderr := &liveStream{live: l, labelled: true, trace: &traceTranslator{sourceLines: sourceLines}}
+	l.streams = []*liveStream{stdout, stderr}
+	return stdout, stderr
+}
+
+// end shows what is left of the output once the program has stopped.
+// The output shown always ends with a newline.
+func (l *liveOutput) end() {
+	for _, each := range l.streams {
+		each.flush()
+	}
+	l.streams = nil
+	if l.written && !l.newline {
+		l.write("\n", false)
+	}
+}
+
+// write shows the text ; optionally on a new line
+func (l *liveOutput) write(text string, onNewLine bool) {
+	if len(text) == 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if onNewLine && !l.newline {
+		io.WriteString(l.out, "\n")
+	}
+	io.WriteString(l.out, text)
+	l.written = true
+	l.newline = strings.HasSuffix(text, "\n")
+}
+
+// Write is part of io.Writer ; marks are taken out and decide which output is shown
+func (s *liveStream) Write(p []byte) (int, error) {
+	s.buffer = append(s.buffer, p...)
+	for {
+		begin := bytes.Index(s.buffer, []byte(outputMarkBegin))
+		if begin == -1 {
+			break
+		}
+		end := bytes.Index(s.buffer[begin+len(outputMarkBegin):], []byte(outputMarkEnd))
+		if end == -1 {
+			// wait for the rest of the mark
+			s.emit(s.buffer[:begin])
+			s.buffer = append([]byte{}, s.buffer[begin:]...)
+			return len(p), nil
+		}
+		s.emit(s.buffer[:begin])
+		mark := s.buffer[begin+len(outputMarkBegin) : begin+len(outputMarkBegin)+end]
+		if next, err := strconv.Atoi(string(mark)); err == nil {
+			s.flushLine()
+			s.mark = next
+		}
+		s.buffer = s.buffer[begin+len(outputMarkBegin)+end+len(outputMarkEnd):]
+	}
+	// keep what can be the start of a mark
+	keep := bytes.LastIndex(s.buffer, []byte(outputMarkBegin[:1]))
+	if keep == -1 || !strings.HasPrefix(outputMarkBegin, string(s.buffer[keep:])) {
+		keep = len(s.buffer)
+	}
+	s.emit(s.buffer[:keep])
+	s.buffer = append([]byte{}, s.buffer[keep:]...)
+	return len(p), nil
+}
+
+// shown returns whether the section being written is shown
+func (s *liveStream) shown() bool {
+	return s.mark == s.live.latest || s.mark == printOutputMark
+}
+
+// emit shows output of the current section, if shown ; labelled output is shown per complete line
+func (s *liveStream) emit(data []byte) {
+	if !s.shown() || len(data) == 0 || s.dumped {
+		return
+	}
+	if !s.labelled {
+		s.live.write(string(removeTestFailure(data)), false)
+		return
+	}
+	s.line = append(s.line, data...)
+	for {
+		end := bytes.IndexByte(s.line, '\n')
+		if end == -1 {
+			return
+		}
+		line := string(s.line[:end])
+		s.line = s.line[end+1:]
+		if isDumpBegin(line) {
+			s.dumped, s.line = true, nil
+			s.writeLines(s.trace.flush())
+			return
+		}
+		s.writeLines(s.trace.line(line))
+	}
+}
+
+// flushLine shows the incomplete line and the line held by the trace translator
+func (s *liveStream) flushLine() {
+	if !s.labelled || s.dumped {
+		return
+	}
+	if len(s.line) > 0 {
+		s.writeLines(s.trace.line(string(s.line)))
+		s.line = nil
+	}
+	s.writeLines(s.trace.flush())
+}
+
+// flush shows all that is left
+func (s *liveStream) flush() {
+	s.emit(s.buffer)
+	s.buffer = nil
+	s.flushLine()
+}
+
+func (s *liveStream) writeLines(lines []string) {
+	var buf bytes.Buffer
+	for _, each := range lines {
+		buf.WriteString(stderrLabel)
+		buf.WriteString(each)
+		buf.WriteString("\n")
+	}
+	s.live.write(buf.String(), true)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitOutput(t *testing.T) {
+	output := "\x00rango:1\x00one\n\x00rango:3\x00\x00rango:4\x00four\x00rango:-1\x00printed"
+	sections, last := splitOutput(output)
+	if last != printOutputMark {
+		t.Fatal("last=", last)
+	}
+	if sections[1] != "one\n" || sections[4] != "four" || sections[printOutputMark] != "printed" {
+		t.Fatalf("sections=%v", sections)
+	}
+	if _, ok := sections[3]; !ok {
+		t.Fatal("missing empty section of entry 3")
+	}
+}
+
+func TestLiveOutput(t *testing.T) {
+	sourceLines = []SourceHolder{}
+	var shown bytes.Buffer
+	output := newLiveOutput(&shown)
+	output.show(2)
+	stdout, stderr := output.writers()
+	// marks can be split over writes
+	for _, each := range []string{"\x00rango:1\x00earlier\n\x00ran", "go:2\x00lat", "est"} {
+		stdout.Write([]byte(each))
+	}
+	stderr.Write([]byte("\x00rango:1\x00hidden\n\x00rango:2\x00warn"))
+	stderr.Write([]byte("ing\n"))
+	stdout.Write([]byte("\x00rango:-1\x003"))
+	output.end()
+	if shown.String() != "latest\n[stderr] warning\n3\n" {
+		t.Fatalf("shown=%q", shown.String())
+	}
+}
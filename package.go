@@ -0,0 +1,130 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+)
+
+// the test that runs the entries inside a package
+const packageTestName = "TestRango"
+
+var (
+	// matches the report of the test framework if the entries panic, e.g. --- FAIL: TestRango (0.00s)
+	testFailure = regexp.MustCompile(`--- FAIL: ` + packageTestName + ` \([0-9.]+s\)\n`)
+	// package option
+	Package = flag.Bool("package", true, "evaluate entries inside the Go package of the current directory, if any")
+	// name and directory of the package that the entries are part of ; empty if they make a program of their own
+	packageName, packageDir string
+)
+
+// openPackage finds the Go package in the current directory.
+// If there is one then entries are compiled as an internal test of that package and its module is used.
+func openPackage() error {
+	if !*Package {
+		return nil
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	found, err := build.ImportDir(dir, 0)
+	if _, none := err.(*build.NoGoError); none {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	packageName, packageDir = found.Name, dir
+	return nil
+}
+
+// programPackage returns the name of the package of the generated source
+func programPackage() string {
+	if len(packageName) > 0 {
+		return packageName
+	}
+	return "main"
+}
+
+// entryFunction returns the name of the function of the generated source that runs the entries
+func entryFunction() string {
+	if len(packageName) > 0 {
+		return packageTestName
+	}
+	return "main"
+}
+
+// packageSourceName returns the path of the generated source as part of the package.
+// The file is not written there ; the go tool reads it from the workspace (see -overlay).
+func packageSourceName(imageName string) string {
+	return filepath.Join(packageDir, imageName+"_test.go")
+}
+
+// packageTestCommand returns the command that compiles the package with the generated source into a test executable
+func packageTestCommand(imageName, gosource, executable string) (*exec.Cmd, error) {
+	source, err := filepath.Abs(gosource)
+	if err != nil {
+		return nil, err
+	}
+	// the go tool runs in the package directory
+	if executable, err = filepath.Abs(executable); err != nil {
+		return nil, err
+	}
+	overlay, err := json.Marshal(map[string]map[string]string{"Replace": {packageSourceName(imageName): source}})
+	if err != nil {
+		return nil, err
+	}
+	overlayFile, err := filepath.Abs(workspacePath(imageName + ".overlay.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(overlayFile, overlay, 0644); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("go", "test", "-c", "-vet=off", "-overlay", overlayFile, "-o", executable, ".")
+	cmd.Dir = packageDir
+	return cmd, nil
+}
+
+// parsePackage parses the Go sources of the package including its internal tests
+func parsePackage(fileSet *token.FileSet) ([]*ast.File, error) {
+	found, err := build.ImportDir(packageDir, 0)
+	if err != nil {
+		return nil, err
+	}
+	files := []*ast.File{}
+	for _, each := range append(found.GoFiles, found.TestGoFiles...) {
+		file, err := parser.ParseFile(fileSet, filepath.Join(packageDir, each), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// removeTestFailure removes the report of the test framework from the output of the entries ; the panic explains itself
+func removeTestFailure(output []byte) []byte {
+	if len(packageName) == 0 {
+		return output
+	}
+	return testFailure.ReplaceAll(output, nil)
+}
+
+// packageTestArgs returns the arguments of the test executable to run only the entries
+func packageTestArgs() []string {
+	return []string{"-test.run=^" + packageTestName + "$"}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// inPackage makes the entries part of a package with an unexported function in a new directory
+func inPackage(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/shapes\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "shapes.go"), []byte("package shapes\n\nfunc double(n int) int { return 2 * n }\n\ntype point struct{ X int }\n"), 0644)
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		packageName, packageDir = "", ""
+	})
+	if err := openPackage(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnalyzeInPackage(t *testing.T) {
+	inPackage(t)
+	if packageName != "shapes" {
+		t.Fatalf("package=%q", packageName)
+	}
+	newSession(Result{})
+	dispatch("d := double(21)")
+	source := string(generateSource(buildTemplateVars(sourceLines, nil)))
+	if !strings.HasPrefix(source, "package shapes\n") || !strings.Contains(source, "func TestRango(*rango_testing.T) {") {
+		t.Fatalf("source=%s", source)
+	}
+	if len(sourceLines[0].Defines) != 1 || typeString(sourceLines[0].Defines[0].Type()) != "int" {
+		t.Fatalf("defines=%v", sourceLines[0].Defines)
+	}
+	if len(sourceLines[0].Uses) != 1 || sourceLines[0].Uses[0].Name() != "double" {
+		t.Fatalf("uses=%v", sourceLines[0].Uses)
+	}
+	// types of the package are not qualified
+	dispatch("p := point{}")
+	if holder := enteredHolder(sourceLines, 2); len(holder.Defines) != 1 || typeString(holder.Defines[0].Type()) != "point" {
+		t.Fatalf("defines=%v", holder.Defines)
+	}
+}
+
+func TestRemoveTestFailure(t *testing.T) {
+	inPackage(t)
+	output := "\x00rango:2\x00--- FAIL: TestRango (0.00s)\npanic: boom\n"
+	if removed := string(removeTestFailure([]byte(output))); removed != "\x00rango:2\x00panic: boom\n" {
+		t.Fatalf("removed=%q", removed)
+	}
+}
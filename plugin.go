@@ -0,0 +1,455 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pluginHost is a long-lived process that loads and runs each entry compiled as a Go plugin.
+// Variables are kept in a registry inside the host such that goroutines, files and connections survive entries.
+type pluginHost struct {
+	executable string // removed when the host stops ; a shell that sets limits starts it after Start returns
+	cmd        *exec.Cmd
+	in         io.WriteCloser // the plugins to run
+	stdin      *os.File       // the standard input of the plugins
+	stdinRead  *os.File       // the end of that pipe read by the plugins
+	unread     []byte         // input typed ahead that the last plugin did not read ; given to the next
+	out        *bufio.Reader
+	EntryCount int               // Entries up to this count have been run by the host
+	Types      map[string]string // Go type (as printed by %T) of each variable in the registry by its key
+	InputRead  int64             // How far the last plugin read its input file, if any
+	loaded     int               // Number of plugins built ; each plugin needs a unique file name
+	limits     limits            // the resource limits of the host process
+	modules    int               // the changes of the session go.mod when the host was built
+}
+
+// pluginHolders keeps the holders of each plugin with their line numbers, by the name of its Go source.
+// Goroutines started by a plugin keep running in the host ; their frames are located in the entries of that plugin.
+var pluginHolders = map[string][]SourceHolder{}
+
+// pluginEvaluator compiles the entries not yet run by its host as a plugin and lets the host run it.
+// The host writes both standard output and standard error to the Stdout of a Result.
+type pluginEvaluator struct {
+	imageName string
+	host      *pluginHost // the running plugin host, if any
+}
+
+const (
+	hostTypeMark  = "type:"
+	hostInputMark = "input:"
+	hostEndMark   = "end:"
+)
+
+func hostName(imageName string) string {
+	return fmt.Sprintf("%s_host", imageName)
+}
+
+// startPluginHost generates, compiles and starts the host program
+func startPluginHost(imageName string) (*pluginHost, Result) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" {
+		return nil, failure(GenerationError, errors.New("unsupported"), "[rango] plugins are not supported on "+runtime.GOOS)
+	}
+	gosource := workspacePath(hostName(imageName) + ".go")
+	if err := ioutil.WriteFile(gosource, []byte(hostSource()), 0644); err != nil {
+		return nil, failure(GenerationError, err, "[rango] generate host source failed")
+	}
+	defer os.Remove(gosource)
+	executable := workspacePath(hostName(imageName))
+	stdout, stderr, err := runCommand(goCommand("build", "-o", executable, gosource), false, nil)
+	if err != nil {
+		return nil, compilationFailure(err, stdout, stderr)
+	}
+	// the limits apply to the host as a whole ; it uses cpu time for all entries
+	cmd := programCommand(executable, programLimits)
+	// the host reads the plugins to run from file descriptor 3 ; its standard input is left to the plugins
+	pipes := [][2]*os.File{}
+	for i := 0; i < 3; i++ {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			closePipes(pipes)
+			return nil, failure(ExecutionError, err, "[rango] connect to host failed")
+		}
+		pipes = append(pipes, [2]*os.File{reader, writer})
+	}
+	commands, stdin, output := pipes[0], pipes[1], pipes[2]
+	cmd.ExtraFiles = []*os.File{commands[0]}
+	cmd.Stdin = stdin[0]
+	cmd.Stdout = output[1]
+	cmd.Stderr = output[1]
+	cmd.SysProcAttr = newProcessGroup()
+	err = cmd.Start()
+	// only the host uses these ends of the pipes ; the end of its standard input is kept to take back unread input
+	commands[0].Close()
+	output[1].Close()
+	if err != nil {
+		commands[1].Close()
+		stdin[0].Close()
+		stdin[1].Close()
+		output[0].Close()
+		os.Remove(executable)
+		return nil, failure(ExecutionError, err, "[rango] start host failed")
+	}
+	return &pluginHost{executable: executable, cmd: cmd, in: commands[1], stdin: stdin[1], stdinRead: stdin[0], out: bufio.NewReader(output[0]), Types: map[string]string{}, limits: programLimits, modules: moduleChanges}, Result{}
+}
+
+// closePipes closes both ends of each pipe
+func closePipes(pipes [][2]*os.File) {
+	for _, each := range pipes {
+		each[0].Close()
+		each[1].Close()
+	}
+}
+
+// stop ends the host process ; all its state is lost.
+// Return the error of waiting for the process which holds its exit status.
+func (h *pluginHost) stop() error {
+	h.in.Close()
+	h.stdin.Close()
+	h.stdinRead.Close()
+	h.cmd.Process.Kill()
+	defer os.Remove(h.executable)
+	return h.cmd.Wait()
+}
+
+// Evaluate is part of Evaluator
+func (e *pluginEvaluator) Evaluate(sourceLines []SourceHolder) Result {
+	if e.host != nil && (e.host.limits != programLimits || e.host.modules != moduleChanges) {
+		// limits are set when a process starts ; a plugin cannot load another version of a package already loaded
+		e.host.stop()
+		e.host = nil
+	}
+	if e.host == nil {
+		started, result := startPluginHost(e.imageName)
+		if result.Failed() {
+			return result
+		}
+		e.host = started
+	}
+	host := e.host
+	// generate ; the host refuses to load two plugins with the same path which is derived from the source name
+	host.loaded++
+	pluginName := workspacePath(fmt.Sprintf("%s_%d", e.imageName, host.loaded))
+	gosource := pluginName + ".go"
+	imageVars := host.templateVars(sourceLines)
+	err := generate(gosource, imageVars)
+	if err != nil {
+		return failure(GenerationError, err, "[rango] generate Go source failed")
+	}
+	pluginHolders[filepath.Base(gosource)] = imageVars.holders()
+	if !*DEBUG {
+		defer os.Remove(gosource)
+	}
+	// build
+	pluginFile := fmt.Sprintf("%s.so", pluginName)
+	stdout, stderr, err := runCommand(goCommand("build", "-buildmode=plugin", "-o", pluginFile, gosource), false, nil)
+	if err != nil {
+		result := compilationFailure(err, stdout, stderr)
+		if host.EntryCount > 0 && inGeneratedCode(sourceLines, result.Diagnostics) {
+			// the variables cannot be restored this way ; a new host runs all entries again
+			host.stop()
+			e.host = nil
+			return e.Evaluate(sourceLines)
+		}
+		return result
+	}
+	// run ; the host removes the plugin file once loaded
+	pluginPath, _ := filepath.Abs(pluginFile)
+	// after a restart of the host, the entries run again read their input again
+	replayed := replayedInput(imageVars)
+	inputPath := ""
+	if !readsTerminal() {
+		if inputPath, err = writeInputFile(replayed); err != nil {
+			return failure(ExecutionError, err, "[rango] write input failed")
+		}
+	}
+	start := time.Now()
+	var output, status string
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		output, status, err = host.run(pluginPath, inputPath)
+		done <- err
+	}()
+	var given *programInput
+	if len(inputPath) == 0 {
+		given = forwardInput(host.stdin, host.stdinRead, false, replayed, host.unread)
+	}
+	// stopping the plugin means stopping the host
+	err = waitProcessGroup(host.cmd.Process.Pid, done, true)
+	if given != nil {
+		latestInput = given.stop()
+		host.unread = given.unread
+	} else {
+		latestInput = inputGiven(inputPath, len(replayed), host.InputRead)
+	}
+	result := Result{Stdout: output, Duration: time.Since(start)}
+	if err != nil {
+		os.Remove(pluginFile)
+		waited := host.stop()
+		result.Kind, result.Err, result.ExitCode, result.Signal = ExecutionError, err, exitCode(waited), exitSignal(waited)
+		e.host = nil
+		result.Stderr = "[rango] host process stopped ; all entries will be run again"
+		return result
+	}
+	if status != "ok" {
+		result.Kind, result.Err = ExecutionError, fmt.Errorf("plugin %s", status)
+		return result
+	}
+	// success
+	if len(sourceLines) > 0 {
+		host.EntryCount = sourceLines[len(sourceLines)-1].EntryCount
+	}
+	result.Kind = NoError
+	return result
+}
+
+// Forget is part of Evaluator.
+// It makes sure that the host does not consider entries starting at a given entry count as run.
+// Note that the effects of these entries on the host process cannot be undone.
+func (e *pluginEvaluator) Forget(from int) {
+	if e.host != nil && e.host.EntryCount >= from {
+		e.host.EntryCount = from - 1
+	}
+}
+
+// run asks the host to load and run a plugin and reads its output until the host reports the end.
+// If an input file is given then the plugin reads it instead of the standard input of the host.
+// Return the output, the status reported by the host and an error if the host is gone.
+func (h *pluginHost) run(pluginPath, inputPath string) (string, string, error) {
+	if _, err := fmt.Fprintf(h.in, "%s\t%s\n", pluginPath, inputPath); err != nil {
+		return "", "", err
+	}
+	var output bytes.Buffer
+	types := map[string]string{}
+	h.InputRead = 0
+	for {
+		chunk, err := h.out.ReadString(outputMarkEnd[0])
+		if err != nil {
+			output.WriteString(chunk)
+			return output.String(), "", err
+		}
+		output.WriteString(chunk)
+		// a host mark ends with the chunk just read
+		begin := bytes.LastIndex(output.Bytes(), []byte(outputMarkBegin))
+		if begin == -1 || begin+len(outputMarkBegin) > output.Len()-1 {
+			continue
+		}
+		mark := string(output.Bytes()[begin+len(outputMarkBegin) : output.Len()-1])
+		switch {
+		case strings.HasPrefix(mark, hostTypeMark):
+			nameType := strings.SplitN(mark[len(hostTypeMark):], "=", 2)
+			if len(nameType) == 2 {
+				types[nameType[0]] = nameType[1]
+			}
+			output.Truncate(begin)
+		case strings.HasPrefix(mark, hostInputMark):
+			h.InputRead, _ = strconv.ParseInt(mark[len(hostInputMark):], 10, 64)
+			output.Truncate(begin)
+		case strings.HasPrefix(mark, hostEndMark):
+			output.Truncate(begin)
+			h.Types = types
+			return output.String(), mark[len(hostEndMark):], nil
+		}
+	}
+}
+
+// templateVars creates the templateVars for a plugin that restores the variables of the entries already run
+// from the registry, runs all other entries and stores all variables back into the registry.
+// Variables of types that cannot be written (e.g. declared by the entries) are not restored ;
+// the entries already run that refer to them are run again, as for a snapshot.
+func (h *pluginHost) templateVars(sourceLines []SourceHolder) templateVars {
+	var restore *snapshot
+	keys := map[string]string{}
+	named := &restoreTypes{aliases: map[string]string{}}
+	if h.EntryCount > 0 {
+		restore = &snapshot{EntryCount: h.EntryCount, Values: map[string]snapshotValue{}, Package: map[string]int{}}
+		holders := map[string]SourceHolder{}
+		for _, each := range sourceLines {
+			if Declaration != each.Type && each.EntryCount <= h.EntryCount {
+				for _, name := range each.Variables() {
+					if name != "_" {
+						keys[name] = registryKey(name, each.EntryCount)
+						holders[name] = each
+					}
+				}
+			}
+		}
+		// each plugin has its own package variables ; these are assigned from the registry if their Declaration was run
+		for name, entry := range packageVariables(sourceLines) {
+			for _, each := range sourceLines {
+				if Declaration == each.Type && each.EntryCount == entry && entry <= h.EntryCount {
+					keys[name] = registryKey(name, entry)
+					holders[name] = each
+					restore.Package[name] = entry
+				}
+			}
+		}
+		replayed := map[string]bool{}
+		for name, holder := range holders {
+			restore.Values[name] = snapshotValue{}
+			if len(h.restoredType(holder, name, keys[name], sourceLines, &restoreTypes{aliases: map[string]string{}})) == 0 {
+				replayed[name] = true
+			}
+		}
+		restore.Replayed = restore.replayedEntries(sourceLines, replayed)
+		for _, name := range restore.names() {
+			if replayed[name] {
+				delete(restore.Values, name)
+			} else {
+				restore.Values[name] = snapshotValue{Type: h.restoredType(holders[name], name, keys[name], sourceLines, named)}
+			}
+		}
+	}
+	imageVars := buildTemplateVars(sourceLines, restore)
+	imageVars.Main = "Run(rango_vars map[string]interface{})"
+	if restore != nil {
+		imageVars.Restore = registryRestoreSource(restore, keys)
+		imageVars.RestoreImports = named.imports()
+	}
+	imageVars.Save = registrySaveSource(sourceLines)
+	return imageVars
+}
+
+// restoredType returns the Go source of the type of a variable restored from the registry ; empty if it cannot be written.
+// That is its static type if the entries are analyzed, otherwise the type of its value as recorded by the host.
+func (h *pluginHost) restoredType(holder SourceHolder, name, key string, sourceLines []SourceHolder, named *restoreTypes) string {
+	for _, object := range holder.Defines {
+		if variable, ok := object.(*types.Var); ok && variable.Name() == name {
+			return named.typeName(variable.Type())
+		}
+	}
+	return named.valueType(h.Types[key], sourceLines)
+}
+
+// registryKey returns the key in the registry for a variable declared by an entry.
+// A variable declared again by a later entry is stored next to the earlier one such that undo can restore it.
+func registryKey(name string, entryCount int) string {
+	return fmt.Sprintf("%s#%d", name, entryCount)
+}
+
+// registryRestoreSource returns a single line of Go source that declares all variables of the snapshot
+// and assigns their values from the registry using their keys
+func registryRestoreSource(restore *snapshot, keys map[string]string) string {
+	var buf bytes.Buffer
+	for _, each := range restore.names() {
+		// a nil value of an interface type is restored as such
+		if _, ok := restore.Package[each]; ok {
+			fmt.Fprintf(&buf, "%s, _ = rango_vars[%q].(%s); ", each, keys[each], restore.Values[each].Type)
+		} else {
+			fmt.Fprintf(&buf, "var %s, _ = rango_vars[%q].(%s); _ = %s; ", each, keys[each], restore.Values[each].Type, each)
+		}
+	}
+	return strings.TrimSuffix(buf.String(), "; ")
+}
+
+// registrySaveSource returns the Go source that stores the values of all user variables into the registry,
+// including package variables
+func registrySaveSource(sourceLines []SourceHolder) string {
+	keys := map[string]string{}
+	for name, entry := range packageVariables(sourceLines) {
+		keys[name] = registryKey(name, entry)
+	}
+	for _, each := range sourceLines {
+		if Declaration == each.Type {
+			continue
+		}
+		for _, name := range each.Variables() {
+			if name != "_" {
+				// the latest declaration is the one in scope
+				keys[name] = registryKey(name, each.EntryCount)
+			}
+		}
+	}
+	names := []string{}
+	for name, key := range keys {
+		names = append(names, fmt.Sprintf("rango_vars[%q] = %s", key, name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, "; ")
+}
+
+// hostSource returns the Go program that loads and runs the plugins
+func hostSource() string {
+	return `package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"plugin"
+	"runtime/debug"
+	"strings"
+)
+
+func main() {
+	vars := map[string]interface{}{}
+	in := bufio.NewReader(os.NewFile(3, "rango"))
+	stdin := os.Stdin
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		// the plugin to run and its input file, if any
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), "\t", 2)
+		var input *os.File
+		if len(fields) == 2 && len(fields[1]) > 0 {
+			if input, err = os.Open(fields[1]); err == nil {
+				os.Stdin = input
+			}
+		}
+		status := run(fields[0], vars)
+		if input != nil {
+			offset, _ := input.Seek(0, io.SeekCurrent)
+			fmt.Printf("\x00rango:input:%d\x00", offset)
+			input.Close()
+			os.Stdin = stdin
+		}
+		for name, value := range vars {
+			fmt.Printf("\x00rango:type:%s=%T\x00", name, value)
+		}
+		fmt.Printf("\x00rango:end:%s\x00", status)
+	}
+}
+
+func run(file string, vars map[string]interface{}) (status string) {
+	loaded, err := plugin.Open(file)
+	os.Remove(file)
+	if err != nil {
+		fmt.Println(err)
+		return "load failed"
+	}
+	symbol, err := loaded.Lookup("Run")
+	if err != nil {
+		fmt.Println(err)
+		return "lookup failed"
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("panic: %v\n\n%s", r, debug.Stack())
+			status = "panicked"
+		}
+	}()
+	symbol.(func(map[string]interface{}))(vars)
+	return "ok"
+}
+`
+}
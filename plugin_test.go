@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPluginReplaysUnwritableTypes(t *testing.T) {
+	newSession(Result{})
+	dispatch(`import "time"`)
+	dispatch("t := time.Now()")
+	dispatch("type P struct{ X int }")
+	dispatch("p := P{1}")
+	dispatch("p.X++")
+	host := &pluginHost{EntryCount: entryCount, Types: map[string]string{}}
+	vars := host.templateVars(sourceLines)
+	if got, want := vars.Restore, `var t, _ = rango_vars["t#2"].(rango_t1.Time); _ = t`; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := vars.RestoreImports, `; import (rango_t1 "time")`; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	// the entries of p are run again
+	if got := strings.Join(sourcesOf(vars.Statements), "; "); !strings.HasPrefix(got, "p := P{1}; p.X++;") {
+		t.Fatalf("statements=%q", got)
+	}
+}
+
+func TestPluginRestoresPackageVariables(t *testing.T) {
+	newSession(Result{})
+	dispatch("var ( counter int )")
+	dispatch("counter = 5")
+	host := &pluginHost{EntryCount: entryCount, Types: map[string]string{}}
+	vars := host.templateVars(sourceLines)
+	if got, want := vars.Restore, `counter, _ = rango_vars["counter#1"].(int)`; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := vars.Save, `rango_vars["counter#1"] = counter`; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
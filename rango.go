@@ -24,6 +24,13 @@ const (
 	NoError
 
 	ShowLineNumbers = true
+
+	// the source of a print produced by =<expression> starts with
+	printExpressionBegin = "rango_fmt.Printf(\"%v\",rango_first("
+	// the source of an expression entry is passed to rango_results to print its results
+	printResultsBegin = "rango_results("
+	// the source of an entry that declares variables again is preceded by a new block
+	openScope = "{ "
 )
 
 var (
@@ -32,25 +39,59 @@ var (
 	sourceLines []SourceHolder
 	entryCount  int
 	logChanges  = false
+	evaluator   Evaluator
+	// functions called by expression entries that turned out to have no results
+	voidCalls = map[string]bool{}
+	// functions called by expression entries whose results are not printed
+	resultsIgnored = map[string]bool{
+		"fmt.Print": true, "fmt.Printf": true, "fmt.Println": true,
+		"fmt.Fprint": true, "fmt.Fprintf": true, "fmt.Fprintln": true}
 	// debug option
 	DEBUG = flag.Bool("debug", false, "produce more output")
+	// snapshot option
+	Snapshot = flag.Bool("snapshot", false, "restore variables from a snapshot instead of replaying all entries")
+	// plugin option
+	PluginHost = flag.Bool("plugin", false, "run each entry as a plugin loaded by one long-lived host process")
 )
 
 func init() {
-	flag.Parse()
 	Stdin = bufio.NewReader(os.Stdin)
 	sourceLines = []SourceHolder{}
 }
 
 func main() {
+	flag.Parse()
 	welcome()
-	if len(os.Args) > 1 { // interpret the last arg as projectname, unless it was an option
-		imageName = os.Args[len(os.Args)-1]
-		if !strings.HasPrefix(imageName, "-") {
-			processChanges()
-			logChanges = true
+	if err := openPackage(); err != nil {
+		log("reading the package in the current directory failed", err)
+		os.Exit(1)
+	}
+	if len(packageName) > 0 {
+		fmt.Printf("[rango] entries are part of package %s\n", packageName)
+		if *PluginHost {
+			// a test cannot be built as a plugin
+			fmt.Println("[rango] -plugin is ignored inside a package")
+			*PluginHost = false
 		}
 	}
+	var err error
+	if programLimits, err = programLimits.with(limitSettings(*Limit)); err != nil {
+		log("invalid -limit", err)
+		os.Exit(1)
+	}
+	if err := openWorkspace(); err != nil {
+		log("create workspace failed", err)
+		os.Exit(1)
+	}
+	if flag.NArg() > 0 { // interpret the first argument after the options as projectname
+		imageName = flag.Arg(0)
+		processChanges()
+		analyzeEntries()
+		logChanges = true
+	}
+	evaluator = newEvaluator(imageName)
+	live = newLiveOutput(os.Stdout)
+	watchInterrupts()
 	loop()
 }
 
@@ -64,25 +105,41 @@ func dispatch(entry string) string {
 	}
 	switch {
 	case strings.HasPrefix(entry, ".v"):
-		fmt.Printf("%v\n", CollectVariables(sourceLines))
-		return ""
+		return handleShowVariables(entry)
+	case strings.HasPrefix(entry, ".timeout"):
+		return handleTimeout(entry)
+	case strings.HasPrefix(entry, ".limit"):
+		return handleLimit(entry)
+	case strings.HasPrefix(entry, ".require"):
+		return handleRequire(entry)
+	case strings.HasPrefix(entry, ".replace"):
+		return handleReplace(entry)
+	case strings.HasPrefix(entry, ".imports"):
+		return handleImports(entry)
 	case strings.HasPrefix(entry, ".q"):
-		os.Exit(0)
+		exit(0)
+	case strings.HasPrefix(entry, ".stdin"):
+		return handleStdin(entry)
 	case strings.HasPrefix(entry, ".s"):
 		return handlePrintSource(ShowLineNumbers)
 	case strings.HasPrefix(entry, ".u"):
 		return handleUndo()
+	case strings.HasPrefix(entry, ".o"):
+		return handleShowOutput(entry)
 	case strings.HasPrefix(entry, ".?"):
 		return handleHelp()
 	case strings.HasPrefix(entry, "="):
-		return handlePrintExpressionValue(entry[1:])
+		return handlePrintExpressionValue(entry)
 	case strings.HasPrefix(entry, "!"):
 		wantsLog := logChanges
 		logChanges = false
+		before := entryCount
 		out := handleSource(entry[1:], GenerateCompileRun)
-		undo(entryCount)
+		// a failed entry is undone already
+		if entryCount > before {
+			undo(before + 1)
+		}
 		logChanges = wantsLog
-		// TODO if handleSource failed then undo is done twice =>  Need (string,error) return values!
 		return out
 	case strings.HasPrefix(entry, "."):
 		return handleUnknownCommand(entry)
@@ -91,7 +148,7 @@ func dispatch(entry string) string {
 }
 
 func handleHelp() string {
-	return "[rango] .q = quit, !<source> = eval once , =<source> = print once, .v = variables, .s = source, .u = undo, .? = help"
+	return "[rango] .q = quit, !<source> = eval once , =<source> = print once, .v [pattern] = variables, .s = source, .u = undo, .o [N] = output of entry N, .timeout [duration] = stop long running programs, .stdin [file|-] = input of programs, .limit [mem=512M cpu=10s files=256|off] = resource limits of programs, .require module@version, .replace path=>dir = modules, .imports [remove name|path] = imports, .? = help"
 }
 
 func handleUndo() string {
@@ -106,6 +163,9 @@ func handleSource(entry string, mode int) string {
 	if strings.HasPrefix(entry, "import") {
 		return handleImport(entry)
 	}
+	if IsDeclaration(entry) {
+		return handleDeclaration(entry, mode)
+	}
 	if isVariable(entry) {
 		if GenerateCompileRun == mode {
 			return handlePrintExpressionValue(entry)
@@ -113,38 +173,132 @@ func handleSource(entry string, mode int) string {
 			return ""
 		}
 	}
-	assigned, declared, err := ParseVariables(entry)
+	assigned, declared, mutated, err := ParseVariables(entry)
 	if err != nil { // error is already printed
 		return ""
 	}
+	if len(assigned) == 0 && len(declared) == 0 && len(mutated) == 0 && IsExpressionStatement(entry) {
+		return handleExpression(entry, mode)
+	}
 	entryCount++
-	if len(assigned) > 0 {
+	// a mutated variable is printed like an assigned one ; unless it is not known,
+	// e.g. a package variable such as http.DefaultClient or a variable local to a block
+	for _, each := range mutated {
+		if isVariable(each) {
+			assigned = append(assigned, each)
+		}
+	}
+	assigned, declared = uniqueNames(assigned), uniqueNames(declared)
+	defined := uniqueNames(ParseDefinedNames(entry))
+	switch {
+	case redeclares(defined):
+		handleRedeclarations(defined, assigned, entry)
+	case len(declared) > 0:
+		// a mix of declarations and assignments is one entry that declares
+		handleVariableDeclarations(declared, assigned, entry)
+	case len(assigned) > 0:
 		handleVariableAssignments(assigned, entry)
+	default:
+		addEntry(NewStatement(entryCount, entry))
+	}
+	return evaluateEntry(mode)
+}
+
+// handleDeclaration adds a top-level declaration.
+// It replaces any earlier declaration of the same names ; an earlier grouped declaration is only replaced as a whole.
+func handleDeclaration(entry string, mode int) string {
+	names, variables, err := ParseDeclaration(entry)
+	if err != nil { // error is already printed
+		return ""
 	}
-	if len(declared) > 0 {
-		handleVariableDeclarations(declared, entry)
+	if count, others := partlyReplaced(sourceLines, names); count > 0 {
+		return fmt.Sprintf("[rango] entry %d also declares %s ; declare them again together to replace it", count, strings.Join(others, ", "))
 	}
-	// TODO handle mix in one entry
-	if len(assigned) == 0 && len(declared) == 0 {
-		addEntry(NewStatement(entryCount, entry))
+	// a function may be declared again with results
+	voidCalls = map[string]bool{}
+	entryCount++
+	addEntry(NewDeclaration(entryCount, entry, names, variables))
+	if len(variables) > 0 {
+		handlePrintVariableValues(variables)
 	}
-	if UpdateSourceOnly == mode {
+	return evaluateEntry(mode)
+}
+
+// handleExpression handles an entry that is a single expression and prints its results the way = does.
+// An expression that only computes a value is not kept as an entry.
+func handleExpression(entry string, mode int) string {
+	if !HasSideEffects(entry) {
+		if GenerateCompileRun == mode {
+			return handlePrintExpressionValue(entry)
+		}
 		return ""
 	}
-	output, err, kind := generate_compile_run(imageName, sourceLines)
-	if err != nil {
-		// output has reason for failure
-		undo(entryCount)
-		// if compiler error then parse it to produce better output
-		if CompilationError == kind {
-			output = prepareCompilerErrorOutput(output)
+	entryCount++
+	expression := NewStatement(entryCount, entry)
+	called := CalledFunction(entry)
+	expression.PrintsResults = !resultsIgnored[called] && !voidCalls[called]
+	addEntry(expression)
+	return evaluateEntry(mode)
+}
+
+// evaluate runs all entries ; the output of the latest entry (or print) is shown live if enabled.
+// Expressions that the compiler reports to have no value are no longer printed and all entries are run again.
+func evaluate(latest int) Result {
+	if live != nil {
+		live.show(latest)
+	}
+	clearInterrupts()
+	latestInput = nil
+	for {
+		result := evaluator.Evaluate(sourceLines)
+		if CompilationError != result.Kind || !(forgetVoidResults(result.Diagnostics) || addMissingImports(result.Diagnostics)) {
+			return result
 		}
-	} else {
-		if logChanges {
-			dumpChanges()
+	}
+}
+
+// forgetVoidResults stops printing the results of expressions reported by the compiler to have no value.
+// Return whether any was found.
+func forgetVoidResults(diagnostics []string) bool {
+	found := false
+	for _, each := range diagnostics {
+		if holder := voidExpression(sourceLines, each); holder != nil {
+			holder.PrintsResults = false
+			voidCalls[CalledFunction(holder.Source)] = true
+			found = true
 		}
 	}
-	return output
+	return found
+}
+
+// evaluateEntry runs all entries and returns the output of the latest.
+// If the evaluation fails then the latest entry is undone.
+func evaluateEntry(mode int) string {
+	if UpdateSourceOnly == mode {
+		return ""
+	}
+	result := evaluate(entryCount)
+	if result.Failed() {
+		// result has reason for failure ; only show the output of the failing entry
+		output := failureOutput(result, entryCount)
+		undo(entryCount)
+		return output
+	}
+	if logChanges {
+		dumpChanges()
+	}
+	analyzeEntries()
+	// only show and record the output of the latest entry ; its input is given again when it is run again
+	entryOutputs[entryCount] = latestOutput(result, entryCount)
+	recordInput(entryCount)
+	return unshownOutput(result, entryOutputs[entryCount])
+}
+
+// analyzeEntries type-checks all entries ; if that fails then variables are known by the names parsed only
+func analyzeEntries() {
+	if err := analyze(sourceLines); err != nil && *DEBUG {
+		log("analysis failed", err)
+	}
 }
 
 func handleVariableAssignments(names []string, entry string) {
@@ -164,15 +318,64 @@ func handleVariableAssignments(names []string, entry string) {
 	}
 	handlePrintVariableValues(names)
 }
-func handleVariableDeclarations(names []string, entry string) {
+
+// handleVariableDeclarations adds an entry that declares variables and possibly assigns others.
+// Assigned variables that are not yet declared are declared by the entry too.
+func handleVariableDeclarations(declared, assigned []string, entry string) {
+	names := declared
+	for _, each := range assigned {
+		if !isVariable(each) && !containsName(names, each) {
+			names = append(names, each)
+		}
+	}
 	addEntry(NewVariableDecl(entryCount, entry, names))
-	handlePrintVariableValues(names)
+	handlePrintVariableValues(uniqueNames(append(assigned, declared...)))
+}
+
+// redeclares returns whether any of the names is a known variable
+func redeclares(names []string) bool {
+	for _, each := range names {
+		if isVariable(each) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRedeclarations adds an entry that declares variables of which some were declared by earlier entries.
+// The entry opens a new block such that the earlier variables are shadowed, possibly by another type.
+// Undo of the entry removes the block and therefore restores the earlier variables.
+func handleRedeclarations(defined, assigned []string, entry string) {
+	declaration := NewVariableDecl(entryCount, entry, defined)
+	declaration.OpensScope = true
+	addEntry(declaration)
+	handlePrintVariableValues(uniqueNames(append(assigned, defined...)))
+}
+
+// uniqueNames returns the names without duplicates, keeping their order
+func uniqueNames(names []string) []string {
+	unique := []string{}
+	for _, each := range names {
+		if !containsName(unique, each) {
+			unique = append(unique, each)
+		}
+	}
+	return unique
+}
+
+func containsName(names []string, name string) bool {
+	for _, each := range names {
+		if each == name {
+			return true
+		}
+	}
+	return false
 }
 
 func handlePrintVariableValues(names []string) {
-	// fmt.Printf( "%v,%v,%v", a , b ,c )
+	// rango_fmt.Printf( "%v,%v,%v", a , b ,c )
 	var buf bytes.Buffer
-	buf.WriteString("fmt.Printf(\"")
+	buf.WriteString("rango_fmt.Printf(\"")
 	for i := 0; i < len(names); i++ {
 		if i > 0 {
 			buf.WriteString(",")
@@ -199,11 +402,16 @@ func handlePrintSource(withLineNumbers bool) string {
 			if line > 1 {
 				buf.WriteString("\n")
 			}
-			if withLineNumbers {
-				buf.WriteString(fmt.Sprintf("%  d:\t%s", line, each.Source))
-			} else {
-				buf.WriteString(each.Source)
+			writeSource(&buf, line, each.Source, withLineNumbers)
+			line++
+		}
+	}
+	for i, each := range sourceLines {
+		if Declaration == each.Type && !IsReplaced(sourceLines, i) {
+			if line > 1 {
+				buf.WriteString("\n")
 			}
+			writeSource(&buf, line, each.Source, withLineNumbers)
 			line++
 		}
 	}
@@ -214,57 +422,76 @@ func handlePrintSource(withLineNumbers bool) string {
 			if line > 1 {
 				buf.WriteString("\n")
 			}
-			if withLineNumbers {
-				buf.WriteString(fmt.Sprintf("%  d:\t%s", line, each.Source))
-			} else {
-				buf.WriteString(each.Source)
-			}
+			writeSource(&buf, line, each.Source, withLineNumbers)
 			line++
 		}
 	}
 	return string(buf.Bytes())
 }
 
+// writeSource writes the source of an entry ; continuation lines are indented below the first
+func writeSource(buf *bytes.Buffer, line int, source string, withLineNumbers bool) {
+	if !withLineNumbers {
+		buf.WriteString(source)
+		return
+	}
+	buf.WriteString(fmt.Sprintf("%  d:\t%s", line, strings.Replace(source, "\n", "\n\t", -1)))
+}
+
 // handleUnknownCommand is called when the entry did not match a known command
 func handleUnknownCommand(entry string) string {
 	return fmt.Sprintf("[rango] \"%s\": command not found", entry)
 }
 
-// handlePrintExpressionValue adds a print statement to display the value of an expression
-func handlePrintExpressionValue(expression string) string {
-	printEntry := fmt.Sprintf("fmt.Printf(\"%%v\",rango_first(%s))", expression)
-	addEntry(NewPrint(entryCount, printEntry))
-	output, _, _ := generate_compile_run(imageName, sourceLines)
+// handlePrintExpressionValue adds a print statement to display the value of an expression ; entered with or without =
+func handlePrintExpressionValue(entered string) string {
+	printEntry := NewPrint(entryCount, fmt.Sprintf("%s%s))", printExpressionBegin, strings.TrimPrefix(entered, "=")))
+	printEntry.Entered = entered
+	addEntry(printEntry)
+	at := len(sourceLines) - 1
+	result := evaluate(printOutputMark)
+	// imports added for the print are not kept ; they are inserted before it
+	sourceLines = append(sourceLines[:at], sourceLines[len(sourceLines)-1])
 	// no need to rollback entry
-	return output
+	if result.Failed() {
+		return failureOutput(result, printOutputMark)
+	}
+	return unshownOutput(result, latestOutput(result, printOutputMark))
 }
 
-// handleImport adds a non-existing import package.
+// handleImport adds the packages that are not imported yet.
+// Packages imported again are left out ; another name for a package, or a name already given to another package, is not accepted.
 // Source will be updated on the next statement.
 func handleImport(entry string) string {
-	names, err := ParseImports(entry)
+	specs, err := ParseImports(entry)
 	if err != nil { // error is already printed
 		return ""
 	}
+	added, err := newImports(sourceLines, specs, entryCount+1)
+	if err != nil {
+		return "[rango] " + err.Error()
+	}
+	if len(added) == 0 {
+		return fmt.Sprintf("[rango] already imported: %s", strings.TrimPrefix(importSource(specs), "import "))
+	}
+	if len(added) < len(specs) {
+		// without the packages imported already
+		entry = importSource(added)
+	}
 	entryCount++
-	sourceLines = NewImport(entryCount, entry, names).AppendTo(sourceLines)
+	sourceLines = NewImport(entryCount, entry, added).AppendTo(sourceLines)
 	return ""
 }
 
-func prepareCompilerErrorOutput(output string) string {
+// prepareCompilerErrorOutput rewrites each compiler message to name the entry and its source
+func prepareCompilerErrorOutput(diagnostics []string) string {
 	var buf bytes.Buffer
-	lines := strings.Split(output, "\n")
-	written := false
-	for _, each := range lines {
-		if written {
+	for i, each := range diagnostics {
+		if i > 0 {
 			buf.WriteString("\n")
 		}
-		if len(each) > 0 && !strings.HasPrefix(each, "#") {
-			written = true
-			// ./generated_by_rango.go:9: undefined: b
-			// TODO scan for the line number and find the matching sourceLine (first)
-			buf.WriteString(each)
-		}
+		// ./generated_by_rango.go:9: undefined: b
+		buf.WriteString(translateDiagnostic(sourceLines, each))
 	}
 	return string(buf.Bytes())
 }
@@ -287,6 +514,7 @@ func undo(until int) {
 	for {
 		if len(sourceLines) == 0 {
 			fmt.Println("(no go source)")
+			entryCount = 0
 			break
 		}
 		last := sourceLines[len(sourceLines)-1]
@@ -297,6 +525,11 @@ func undo(until int) {
 		}
 		sourceLines = sourceLines[:len(sourceLines)-1]
 	}
+	forgetOutputs(until)
+	forgetInputs(until)
+	evaluator.Forget(until)
+	// the functions may have been declared by the entries undone
+	voidCalls = map[string]bool{}
 }
 
 func log(what string, err error) {
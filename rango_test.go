@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fakeEvaluator records the evaluated entries and returns a prepared Result
+type fakeEvaluator struct {
+	result    Result
+	evaluated [][]SourceHolder
+	forgotten []int
+}
+
+func (f *fakeEvaluator) Evaluate(sourceLines []SourceHolder) Result {
+	f.evaluated = append(f.evaluated, sourceLines)
+	return f.result
+}
+
+func (f *fakeEvaluator) Forget(from int) {
+	f.forgotten = append(f.forgotten, from)
+}
+
+// newSession clears all entries and evaluates using a fake that returns the given Result
+func newSession(result Result) *fakeEvaluator {
+	sourceLines = []SourceHolder{}
+	entryCount = 0
+	entryOutputs = map[int]string{}
+	lastAnalysis.pkg = nil
+	fake := &fakeEvaluator{result: result}
+	evaluator = fake
+	return fake
+}
+
+func TestDispatchDeclaration(t *testing.T) {
+	fake := newSession(Result{Stdout: "\x00rango:1\x00\x00rango:-1\x001"})
+	if output := dispatch("a := 1"); output != "1" {
+		t.Fatalf("output=%q", output)
+	}
+	if len(fake.evaluated) != 1 {
+		t.Fatal("evaluated=", len(fake.evaluated))
+	}
+	// declaration and print
+	if len(sourceLines) != 2 || sourceLines[0].Type != VariableDecl || sourceLines[1].Type != Print {
+		t.Fatalf("sourceLines=%v", sourceLines)
+	}
+	if !isVariable("a") {
+		t.Fatal("a is not a variable")
+	}
+	if entryOutputs[1] != "1" {
+		t.Fatalf("entryOutputs=%v", entryOutputs)
+	}
+}
+
+func TestDispatchCompilationErrorUndoes(t *testing.T) {
+	fake := newSession(Result{Kind: CompilationError, Err: errors.New("exit status 2"), Diagnostics: []string{"undefined: b"}})
+	if output := dispatch("a := b"); output != "undefined: b" {
+		t.Fatalf("output=%q", output)
+	}
+	if len(sourceLines) != 0 || entryCount != 0 {
+		t.Fatalf("sourceLines=%v entryCount=%d", sourceLines, entryCount)
+	}
+	if len(fake.forgotten) != 1 || fake.forgotten[0] != 1 {
+		t.Fatal("forgotten=", fake.forgotten)
+	}
+}
+
+func TestDispatchEvalOnce(t *testing.T) {
+	newSession(Result{Stdout: "\x00rango:1\x00once\n"})
+	if output := dispatch(`!fmt.Println("once")`); output != "once\n" {
+		t.Fatalf("output=%q", output)
+	}
+	if len(sourceLines) != 0 {
+		t.Fatalf("sourceLines=%v", sourceLines)
+	}
+}
+
+func TestDispatchEvalOnceFailureKeepsEntries(t *testing.T) {
+	fake := newSession(Result{})
+	dispatch("a := 1")
+	fake.result = Result{Kind: CompilationError, Err: errors.New("exit status 2"), Diagnostics: []string{"undefined: b"}}
+	dispatch("!a = b")
+	if len(sourceLines) == 0 || entryCount != 1 {
+		t.Fatalf("sourceLines=%v entryCount=%d", sourceLines, entryCount)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	fake := newSession(Result{})
+	dispatch("a := 1")
+	dispatch("a = 2")
+	dispatch(".u")
+	for _, each := range sourceLines {
+		if each.EntryCount != 1 {
+			t.Fatalf("sourceLines=%v", sourceLines)
+		}
+	}
+	if entryCount != 1 {
+		t.Fatal("entryCount=", entryCount)
+	}
+	if fake.forgotten[len(fake.forgotten)-1] != 2 {
+		t.Fatal("forgotten=", fake.forgotten)
+	}
+}
+
+func TestHandleVariableAssignments(t *testing.T) {
+	newSession(Result{})
+	dispatch("a := 1")
+	entryCount++
+	handleVariableAssignments([]string{"a"}, "a = 2")
+	if last := sourceLines[len(sourceLines)-2]; last.Type != VariableAssign {
+		t.Fatalf("assign=%v", last)
+	}
+	// b is not yet declared so it is handled as a declaration
+	entryCount++
+	handleVariableAssignments([]string{"a", "b"}, "a, b := 3, 4")
+	if !isVariable("b") {
+		t.Fatal("b is not a variable")
+	}
+}
+
+func TestDispatchMultipleStatements(t *testing.T) {
+	newSession(Result{})
+	dispatch("a := 1")
+	dispatch("a = 2; var b = a; c := b")
+	entered := 0
+	for _, each := range sourceLines {
+		if each.EntryCount == 2 && !each.Hidden {
+			entered++
+			if each.Type != VariableDecl || !equal([]string{"b", "c"}, each.VariableNames) {
+				t.Fatalf("entry=%v", each)
+			}
+		}
+	}
+	if entered != 1 {
+		t.Fatal("entered=", entered)
+	}
+	dispatch(".u")
+	if isVariable("b") || isVariable("c") || !isVariable("a") {
+		t.Fatalf("sourceLines=%v", sourceLines)
+	}
+}
+
+// voidEvaluator reports the first expression with printed results to have no value
+type voidEvaluator struct {
+	evaluations int
+}
+
+func (v *voidEvaluator) Evaluate(sourceLines []SourceHolder) Result {
+	v.evaluations++
+	buildTemplateVars(sourceLines, nil)
+	for _, each := range sourceLines {
+		if each.PrintsResults {
+			diagnostic := fmt.Sprintf("./%s.go:%d:%d: %s (no value) used as value", imageName, each.LineNumber, len(printResultsBegin)+1, each.Source)
+			return Result{Kind: CompilationError, Err: errors.New("exit status 1"), Diagnostics: []string{diagnostic}}
+		}
+	}
+	return Result{}
+}
+
+func (v *voidEvaluator) Forget(from int) {}
+
+func TestDispatchVoidExpression(t *testing.T) {
+	newSession(Result{})
+	void := new(voidEvaluator)
+	evaluator = void
+	dispatch("noop()")
+	if len(sourceLines) != 1 || sourceLines[0].PrintsResults || void.evaluations != 2 {
+		t.Fatalf("sourceLines=%v evaluations=%d", sourceLines, void.evaluations)
+	}
+	// the function is known to have no results
+	dispatch("noop()")
+	if void.evaluations != 3 {
+		t.Fatal("evaluations=", void.evaluations)
+	}
+	// until the entries are undone
+	dispatch(".u")
+	if len(voidCalls) != 0 {
+		t.Fatal("voidCalls=", voidCalls)
+	}
+}
+
+func TestDispatchPartialRedeclaration(t *testing.T) {
+	newSession(Result{})
+	dispatch("type (A int; B int)")
+	if output := dispatch("type A string"); output != "[rango] entry 1 also declares B ; declare them again together to replace it" {
+		t.Fatalf("output=%q", output)
+	}
+	if len(sourceLines) != 1 || entryCount != 1 {
+		t.Fatalf("sourceLines=%v", sourceLines)
+	}
+	dispatch("type (A string; B int)")
+	if len(sourceLines) != 2 || !IsReplaced(sourceLines, 0) {
+		t.Fatalf("sourceLines=%v", sourceLines)
+	}
+}
+
+func TestDispatchValueExpression(t *testing.T) {
+	newSession(Result{})
+	dispatch(`import (str "strings"; "time")`)
+	dispatch("type P int")
+	dispatch("var b str.Builder")
+	// conversions and calls of functions without side effects are printed only
+	for _, each := range []string{"P(3)", "time.Duration(5)", `str.ToUpper("a")`} {
+		dispatch(each)
+		if entryCount != 3 {
+			t.Fatalf("%s kept: sourceLines=%v", each, sourceLines)
+		}
+	}
+	dispatch(`b.WriteString("a")`)
+	if entryCount != 4 {
+		t.Fatal("method call not kept")
+	}
+}
+
+func TestDispatchRedeclaration(t *testing.T) {
+	newSession(Result{})
+	dispatch("a := 1")
+	dispatch(`a := "text"`)
+	last := sourceLines[len(sourceLines)-2]
+	if !last.OpensScope || last.Type != VariableDecl || !last.Analyzed || !equal([]string{"a"}, last.Variables()) {
+		t.Fatalf("entry=%v", last)
+	}
+	if imageVars := buildTemplateVars(sourceLines, nil); imageVars.CloseScopes != " }" {
+		t.Fatalf("close=%q", imageVars.CloseScopes)
+	}
+	if !equal([]string{"a"}, CollectVariables(sourceLines)) {
+		t.Fatalf("variables=%v", CollectVariables(sourceLines))
+	}
+	dispatch(".u")
+	for _, each := range sourceLines {
+		if each.OpensScope {
+			t.Fatalf("sourceLines=%v", sourceLines)
+		}
+	}
+}
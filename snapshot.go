@@ -0,0 +1,416 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// snapshotValue is the encoded value of one variable.
+// The generated program writes these using the same field names (see rango_value).
+type snapshotValue struct {
+	Type string // Go type of the value as printed by %T
+	Data []byte // gob encoding of the value ; empty if the value cannot be encoded without loss
+}
+
+// snapshot holds the values of all user variables after running a given entry
+type snapshot struct {
+	EntryCount int
+	Values     map[string]snapshotValue
+	// entries covered by the snapshot that are run again ; they compute the variables that are not restored
+	Replayed map[int]bool
+	// the entry count of the Declaration of each package variable ; these are assigned rather than declared
+	Package map[string]int
+	// how each restored variable is declared ; set by restorable
+	Declared map[string]restoredVariable
+	// Go source that imports the packages of the declared types
+	Imports string
+}
+
+// restoredVariable is the declaration of a restored variable in the generated source
+type restoredVariable struct {
+	Type string // Go source of its type ; empty for a package variable which is declared already
+	// Go source of the type of its value if that is restored first and then assigned, e.g. for a variable of an interface type
+	Value string
+}
+
+// snapshotEvaluator restores the variables of the latest snapshot instead of replaying all entries.
+// Entries that refer to variables which cannot be restored are replayed.
+// It replays all entries if no snapshot is available or if the program cannot be built with it.
+type snapshotEvaluator struct {
+	imageName string
+	snapshots map[int]snapshot // the snapshot taken after each entry, if any
+}
+
+func newSnapshotEvaluator(imageName string) *snapshotEvaluator {
+	return &snapshotEvaluator{imageName: imageName, snapshots: map[int]snapshot{}}
+}
+
+// Evaluate is part of Evaluator
+func (e *snapshotEvaluator) Evaluate(sourceLines []SourceHolder) Result {
+	// a snapshot is only valid if written by this run
+	os.Remove(snapshotFileName(e.imageName))
+	result := e.evaluate(sourceLines)
+	if !result.Failed() && len(sourceLines) > 0 {
+		e.takeSnapshot(sourceLines)
+	}
+	return result
+}
+
+func (e *snapshotEvaluator) evaluate(sourceLines []SourceHolder) Result {
+	if last := e.latestSnapshot(sourceLines); last != nil && last.writeRestoreFile(e.imageName) == nil {
+		defer os.Remove(restoreFileName(e.imageName))
+		result := generate_compile_run(e.imageName, snapshotTemplateVars(e.imageName, sourceLines, last))
+		if GenerationError != result.Kind && CompilationError != result.Kind {
+			return result
+		}
+		// the snapshot cannot be used with this source ; replay all entries instead
+	}
+	return generate_compile_run(e.imageName, snapshotTemplateVars(e.imageName, sourceLines, nil))
+}
+
+// Forget is part of Evaluator
+func (e *snapshotEvaluator) Forget(from int) {
+	for count := range e.snapshots {
+		if count >= from {
+			delete(e.snapshots, count)
+		}
+	}
+}
+
+var (
+	// matches package qualifiers in type names such as map[string]*strings.Builder
+	packageQualifier = regexp.MustCompile(`\b(\w+)\.`)
+	// matches a qualified type name that is not exported, e.g. *errors.errorString
+	unexportedType = regexp.MustCompile(`\b\w+\.[^A-Z]`)
+)
+
+// restoreTypes writes the types of restored variables in the generated source.
+// Their packages are imported as rango_t1, rango_t2, ... such that the entries need not import them.
+type restoreTypes struct {
+	aliases map[string]string // alias by package path
+	paths   []string          // in the order of their aliases
+	// if true then types declared by the entries are written unqualified ; otherwise these cannot be written
+	ownTypes bool
+	added    int // number of paths added for the type being written
+}
+
+// typeName returns the Go source of a type ; empty if it cannot be written, e.g. not exported by its package
+func (r *restoreTypes) typeName(typ types.Type) string {
+	written := true
+	typeName := types.TypeString(typ, func(pkg *types.Package) string {
+		if pkg.Path() == programPackage() {
+			// types declared by plugins cannot be shared
+			written = written && r.ownTypes
+			return ""
+		}
+		return r.alias(pkg.Path())
+	})
+	return r.accept(typeName, written)
+}
+
+// valueType returns the Go source of a type as printed by %T ; empty if it cannot be written.
+// Its packages are only known by their names ; these are looked up in the imports of the entries.
+func (r *restoreTypes) valueType(typeName string, sourceLines []SourceHolder) string {
+	if typeName == "<nil>" {
+		return ""
+	}
+	paths := map[string]string{}
+	for _, each := range collectImports(sourceLines) {
+		if pkg, err := importPackage(each.Path); err == nil {
+			paths[pkg.Name()] = each.Path
+		}
+	}
+	written := true
+	typeName = packageQualifier.ReplaceAllStringFunc(typeName, func(qualifier string) string {
+		name := strings.TrimSuffix(qualifier, ".")
+		if name == programPackage() {
+			written = written && r.ownTypes
+			return ""
+		}
+		path, ok := paths[name]
+		if !ok {
+			written = false
+			return qualifier
+		}
+		return r.alias(path) + "."
+	})
+	return r.accept(typeName, written)
+}
+
+// alias returns the alias of a package path ; a new alias is kept only if the type being written is accepted
+func (r *restoreTypes) alias(path string) string {
+	alias, ok := r.aliases[path]
+	if !ok {
+		alias = fmt.Sprintf("rango_t%d", len(r.paths)+1)
+		r.aliases[path] = alias
+		r.paths = append(r.paths, path)
+		r.added++
+	}
+	return alias
+}
+
+// accept returns the type name if it can be written ; otherwise the aliases added for it are dropped and it returns empty
+func (r *restoreTypes) accept(typeName string, written bool) string {
+	added := r.paths[len(r.paths)-r.added:]
+	r.added = 0
+	if written && !unexportedType.MatchString(typeName) {
+		return typeName
+	}
+	for _, each := range added {
+		delete(r.aliases, each)
+	}
+	r.paths = r.paths[:len(r.paths)-len(added)]
+	return ""
+}
+
+// imports returns the Go source that imports the packages of the types, to follow other imports on a line
+func (r *restoreTypes) imports() string {
+	if len(r.paths) == 0 {
+		return ""
+	}
+	specs := []string{}
+	for _, each := range r.paths {
+		specs = append(specs, fmt.Sprintf("%s %q", r.aliases[each], each))
+	}
+	return "; import (" + strings.Join(specs, "; ") + ")"
+}
+
+func snapshotFileName(imageName string) string {
+	return workspacePath(imageName + ".snapshot")
+}
+
+func restoreFileName(imageName string) string {
+	return workspacePath(imageName + ".restore")
+}
+
+// takeSnapshot reads the variable values written by the generated program after running the last entry
+func (e *snapshotEvaluator) takeSnapshot(sourceLines []SourceHolder) {
+	entryCount := sourceLines[len(sourceLines)-1].EntryCount
+	fileName := snapshotFileName(e.imageName)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		// program did not reach the end of main
+		return
+	}
+	defer os.Remove(fileName)
+	values := map[string]snapshotValue{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		log("decoding snapshot failed", err)
+		return
+	}
+	e.snapshots[entryCount] = snapshot{EntryCount: entryCount, Values: values, Package: packageVariables(sourceLines)}
+}
+
+// latestSnapshot returns the most recent snapshot with the values that can be restored.
+// Return nil if all entries must be replayed.
+func (e *snapshotEvaluator) latestSnapshot(sourceLines []SourceHolder) *snapshot {
+	latest := 0
+	for count := range e.snapshots {
+		if count > latest {
+			latest = count
+		}
+	}
+	last, ok := e.snapshots[latest]
+	if !ok {
+		return nil
+	}
+	restorable := last.restorable(sourceLines)
+	return &restorable
+}
+
+// restorable returns the snapshot without the values that could not be encoded (e.g. files, functions or channels)
+// or whose types cannot be written, nor those of package variables declared again since.
+// The entries it covers that refer to such variables are replayed ; the variables these refer to are then not restored either.
+func (s snapshot) restorable(sourceLines []SourceHolder) snapshot {
+	replayed := map[string]bool{}
+	declarations := packageVariables(sourceLines)
+	for name, each := range s.Values {
+		entry, assigned := s.Package[name]
+		if assigned && declarations[name] != entry {
+			replayed[name] = true
+			continue
+		}
+		if _, ok := s.declaredVariable(sourceLines, name, &restoreTypes{aliases: map[string]string{}, ownTypes: true}); len(each.Data) == 0 || !ok {
+			replayed[name] = true
+		}
+	}
+	entries := s.replayedEntries(sourceLines, replayed)
+	values, declared := map[string]snapshotValue{}, map[string]restoredVariable{}
+	named := &restoreTypes{aliases: map[string]string{}, ownTypes: true}
+	for _, name := range s.names() {
+		if !replayed[name] {
+			values[name] = s.Values[name]
+			declared[name], _ = s.declaredVariable(sourceLines, name, named)
+		}
+	}
+	return snapshot{EntryCount: s.EntryCount, Values: values, Replayed: entries, Package: s.Package, Declared: declared, Imports: named.imports()}
+}
+
+// replayedEntries returns the entries covered by the snapshot that refer to the variables that are replayed.
+// The variables these entries refer to are then replayed too ; they are added to replayed.
+func (s snapshot) replayedEntries(sourceLines []SourceHolder, replayed map[string]bool) map[int]bool {
+	entries := map[int]bool{}
+	for changed := len(replayed) > 0; changed; {
+		changed = false
+		for _, each := range sourceLines {
+			if each.EntryCount > s.EntryCount || entries[each.EntryCount] || Import == each.Type || Declaration == each.Type || Print == each.Type {
+				continue
+			}
+			identifiers, err := ParseIdentifiers(nil, []string{each.Source})
+			if err != nil || !refersTo(identifiers, replayed) {
+				continue
+			}
+			entries[each.EntryCount] = true
+			for name := range s.Values {
+				if identifiers[name] && !replayed[name] {
+					replayed[name], changed = true, true
+				}
+			}
+		}
+	}
+	return entries
+}
+
+// declaredVariable returns the declaration of a restored variable: with its static type if the entries are analyzed,
+// otherwise with the type of its value. The value of a variable of an interface type is restored as its own type,
+// as is the value of a package variable. Return false if a type cannot be written.
+func (s snapshot) declaredVariable(sourceLines []SourceHolder, name string, named *restoreTypes) (restoredVariable, bool) {
+	if _, ok := s.Package[name]; ok {
+		value := named.valueType(s.Values[name].Type, sourceLines)
+		return restoredVariable{Value: value}, len(value) > 0
+	}
+	var static types.Type
+	for _, each := range sourceLines {
+		if each.EntryCount > s.EntryCount || Declaration == each.Type {
+			continue
+		}
+		for _, object := range each.Defines {
+			if variable, ok := object.(*types.Var); ok && variable.Name() == name {
+				static = variable.Type()
+			}
+		}
+	}
+	if static == nil {
+		value := named.valueType(s.Values[name].Type, sourceLines)
+		return restoredVariable{Type: value}, len(value) > 0
+	}
+	typeName := named.typeName(static)
+	if len(typeName) == 0 || !types.IsInterface(static) {
+		return restoredVariable{Type: typeName}, len(typeName) > 0
+	}
+	value := named.valueType(s.Values[name].Type, sourceLines)
+	return restoredVariable{Type: typeName, Value: value}, len(value) > 0
+}
+
+// refersTo returns whether any of the names is one of the identifiers
+func refersTo(identifiers, names map[string]bool) bool {
+	for each := range names {
+		if identifiers[each] {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRestoreFile writes the values of a snapshot such that the generated program can restore them
+func (s snapshot) writeRestoreFile(imageName string) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s.Values); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(restoreFileName(imageName), buf.Bytes(), 0644)
+}
+
+// names returns the sorted variable names of the snapshot
+func (s snapshot) names() []string {
+	names := []string{}
+	for each := range s.Values {
+		names = append(names, each)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// restoreSource returns a single line of Go source that declares and restores all variables of the snapshot
+func (s snapshot) restoreSource(imageName string) string {
+	var buf bytes.Buffer
+	names := s.names()
+	for _, each := range names {
+		declared := s.Declared[each]
+		if len(declared.Type) > 0 {
+			fmt.Fprintf(&buf, "var %s %s; ", each, declared.Type)
+		}
+		if len(declared.Value) > 0 {
+			fmt.Fprintf(&buf, "var rango_value_%s %s; ", each, declared.Value)
+		}
+	}
+	fmt.Fprintf(&buf, "rango_restore(%q, map[string]interface{}{", restoreFileName(imageName))
+	for i, each := range names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		if len(s.Declared[each].Value) > 0 {
+			fmt.Fprintf(&buf, "%q: &rango_value_%s", each, each)
+		} else {
+			fmt.Fprintf(&buf, "%q: &%s", each, each)
+		}
+	}
+	buf.WriteString("})")
+	for _, each := range names {
+		if len(s.Declared[each].Value) > 0 {
+			fmt.Fprintf(&buf, "; %s = rango_value_%s", each, each)
+		}
+		if len(s.Declared[each].Type) > 0 {
+			fmt.Fprintf(&buf, "; _ = %s", each)
+		}
+	}
+	return buf.String()
+}
+
+// snapshotTemplateVars creates the templateVars for a program that saves all variables at the end of main.
+// If a snapshot is given then its variables are restored at the start of main.
+func snapshotTemplateVars(imageName string, sourceLines []SourceHolder, restore *snapshot) templateVars {
+	imageVars := buildTemplateVars(sourceLines, restore)
+	imageVars.Snapshot = true
+	imageVars.Save = saveSource(imageName, sourceLines)
+	if restore != nil {
+		imageVars.Restore = restore.restoreSource(imageName)
+		imageVars.RestoreImports = restore.Imports
+	}
+	return imageVars
+}
+
+// saveSource returns the Go source that saves the values of all user variables at the end of main, including package variables
+func saveSource(imageName string, sourceLines []SourceHolder) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "rango_save(%q, map[string]interface{}{", snapshotFileName(imageName))
+	saved := map[string]bool{"_": true}
+	variables := []string{}
+	for each := range packageVariables(sourceLines) {
+		variables = append(variables, each)
+	}
+	sort.Strings(variables)
+	for _, each := range append(CollectLocalVariables(sourceLines), variables...) {
+		if saved[each] {
+			continue
+		}
+		if len(saved) > 1 {
+			buf.WriteString(", ")
+		}
+		saved[each] = true
+		fmt.Fprintf(&buf, "%q: %s", each, each)
+	}
+	buf.WriteString("})")
+	return buf.String()
+}
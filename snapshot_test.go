@@ -0,0 +1,134 @@
+package main
+
+import (
+	"go/types"
+	"strings"
+	"testing"
+)
+
+func TestRestorableSnapshot(t *testing.T) {
+	lines := []SourceHolder{
+		NewImport(1, `import ("bufio"; "os"; "time")`, []ImportSpec{{Path: "bufio"}, {Path: "os"}, {Path: "time"}}),
+		NewVariableDecl(1, "w := os.Stdout", []string{"w"}),
+		NewVariableDecl(2, "n := 1", []string{"n"}),
+		NewVariableDecl(3, `b := bufio.NewWriter(w); k := n`, []string{"b", "k"}),
+		NewVariableDecl(4, "t := time.Now()", []string{"t"}),
+		NewStatement(5, "n++")}
+	last := snapshot{EntryCount: 5, Values: map[string]snapshotValue{
+		"w": {Type: "*os.File"}, "n": {Type: "int", Data: []byte{1}}, "b": {Type: "*bufio.Writer"},
+		"k": {Type: "int", Data: []byte{1}}, "t": {Type: "time.Time", Data: []byte{1}}}}
+	restored := last.restorable(lines)
+	// w and b cannot be encoded ; n and k are used by entry 3 that is replayed
+	if len(restored.Values) != 1 || restored.Values["t"].Type != "time.Time" {
+		t.Fatalf("values=%v", restored.Values)
+	}
+	for count, replayed := range map[int]bool{1: true, 2: true, 3: true, 4: false, 5: true} {
+		if restored.Replayed[count] != replayed {
+			t.Fatalf("replayed=%v", restored.Replayed)
+		}
+	}
+	vars := buildTemplateVars(lines, &restored)
+	if len(vars.Statements) != 4 {
+		t.Fatalf("statements=%v", vars.Statements)
+	}
+}
+
+func TestRestoreTypes(t *testing.T) {
+	io := types.NewPackage("io", "io")
+	writer := types.NewNamed(types.NewTypeName(0, io, "Writer", nil), types.NewInterfaceType(nil, nil), nil)
+	errors := types.NewPackage("errors", "errors")
+	errorString := types.NewNamed(types.NewTypeName(0, errors, "errorString", nil), types.NewStruct(nil, nil), nil)
+	bytes := types.NewPackage("bytes", "bytes")
+	buffer := types.NewNamed(types.NewTypeName(0, bytes, "Buffer", nil), types.NewStruct(nil, nil), nil)
+	local := types.NewNamed(types.NewTypeName(0, types.NewPackage(programPackage(), programPackage()), "T", nil), types.Typ[types.Int], nil)
+	named := &restoreTypes{aliases: map[string]string{}}
+	for _, each := range []struct {
+		typ  types.Type
+		want string
+	}{
+		{types.NewSlice(writer), "[]rango_t1.Writer"},
+		{types.NewPointer(errorString), ""},
+		{local, ""},
+		{types.Universe.Lookup("error").Type(), "error"},
+		{types.NewSignature(nil, types.NewTuple(types.NewVar(0, nil, "b", types.NewPointer(buffer)), types.NewVar(0, nil, "p", local)), nil, false), ""},
+		{types.NewMap(types.Typ[types.String], writer), "map[string]rango_t1.Writer"},
+	} {
+		if got := named.typeName(each.typ); got != each.want {
+			t.Fatalf("got %q want %q", got, each.want)
+		}
+	}
+	if got, want := named.imports(), `; import (rango_t1 "io")`; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	// the entries of a snapshot are part of the same program
+	own := &restoreTypes{aliases: map[string]string{}, ownTypes: true}
+	if got := own.typeName(types.NewPointer(local)); got != "*T" {
+		t.Fatalf("got %q", got)
+	}
+	lines := []SourceHolder{NewImport(1, `import str "strings"`, []ImportSpec{{Name: "str", Path: "strings"}})}
+	for _, each := range []struct {
+		typeName, want string
+	}{
+		{"map[string]*strings.Builder", "map[string]*rango_t1.Builder"},
+		{"main.T", "T"},
+		{"bytes.Buffer", ""},
+		{"<nil>", ""},
+	} {
+		if got := own.valueType(each.typeName, lines); got != each.want {
+			t.Fatalf("got %q want %q", got, each.want)
+		}
+	}
+	if got, want := own.imports(), `; import (rango_t1 "strings")`; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestRestoreStaticTypes(t *testing.T) {
+	newSession(Result{})
+	dispatch(`import tm "time"`)
+	dispatch("var e interface{} = 5")
+	dispatch("d := tm.Duration(2)")
+	last := snapshot{EntryCount: entryCount, Values: map[string]snapshotValue{
+		"e": {Type: "int", Data: []byte{1}}, "d": {Type: "time.Duration", Data: []byte{1}}}}
+	restored := last.restorable(sourceLines)
+	if len(restored.Replayed) != 0 {
+		t.Fatalf("replayed=%v", restored.Replayed)
+	}
+	if got, want := restored.Imports, `; import (rango_t1 "time")`; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	source := restored.restoreSource("image")
+	for _, each := range []string{"var d rango_t1.Duration; var e interface{}; var rango_value_e int;", `"e": &rango_value_e`, "; e = rango_value_e; _ = e"} {
+		if !strings.Contains(source, each) {
+			t.Fatalf("source=%s", source)
+		}
+	}
+}
+
+func TestRestorePackageVariables(t *testing.T) {
+	newSession(Result{})
+	dispatch("var ( counter int )")
+	dispatch("counter = 5")
+	dispatch("x := 1")
+	if got := saveSource("image", sourceLines); !strings.HasSuffix(got, `{"x": x, "counter": counter})`) {
+		t.Fatalf("save=%s", got)
+	}
+	last := snapshot{EntryCount: entryCount, Package: packageVariables(sourceLines), Values: map[string]snapshotValue{
+		"counter": {Type: "int", Data: []byte{1}}, "x": {Type: "int", Data: []byte{1}}}}
+	restored := last.restorable(sourceLines)
+	if len(restored.Replayed) != 0 {
+		t.Fatalf("replayed=%v", restored.Replayed)
+	}
+	source := restored.restoreSource("image")
+	for _, each := range []string{"var rango_value_counter int; var x int;", `"counter": &rango_value_counter`, "; counter = rango_value_counter; _ = x"} {
+		if !strings.Contains(source, each) {
+			t.Fatalf("source=%s", source)
+		}
+	}
+	// the value of the earlier declaration is not restored ; its assignment is replayed
+	dispatch("var ( counter int64 )")
+	restored = last.restorable(sourceLines)
+	if _, ok := restored.Values["counter"]; ok || !restored.Replayed[2] || restored.Replayed[3] {
+		t.Fatalf("values=%v replayed=%v", restored.Values, restored.Replayed)
+	}
+}
@@ -5,7 +5,10 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"go/types"
+	"strings"
 )
 
 const (
@@ -14,18 +17,32 @@ const (
 	VariableDecl
 	VariableAssign
 	Print
+	Declaration
 )
 
 // SourceHolder is basically one line of Go source code with meta data
 type SourceHolder struct {
-	EntryCount int    // In which REPL count was this created
-	Type       int    // one of the constants Import,...
-	Source     string // Go code entered or hidden code produced by rango
-	Hidden     bool   // If true then hide this from source listing
-	LineNumber int    // The exact line number in the generated Go source ; used for compiler error reporting
+	EntryCount  int    // In which REPL count was this created
+	Type        int    // one of the constants Import,...
+	Source      string // Go code entered or hidden code produced by rango
+	Hidden      bool   // If true then hide this from source listing
+	LineNumber  int    // The exact line number in the generated Go source ; used for compiler error reporting
+	MarksOutput bool   // If true then the generated source marks the start of the output of this entry
+	// If true then the Source is an expression and the generated source prints its results
+	PrintsResults bool
+	// If true then the generated source opens a block before the Source such that it can declare variables again
+	OpensScope bool
+	// If the holder is of type Print then the expression as entered by the user, e.g. =x or x
+	Entered string
 	// type data
-	PackageNames  []string // If the holder is of type Import then store the packages here
-	VariableNames []string // If the holder is of type VariableDecl then store the variable names here
+	Imports       []ImportSpec // If the holder is of type Import then store the packages with their names here
+	UnusedImports []int        // If the holder is of type Import then the indexes of its Imports that the generated source leaves unused
+	VariableNames []string     // If the holder is of type VariableDecl (or a var block Declaration) then store the variable names here
+	DeclaredNames []string     // If the holder is of type Declaration then store the names of funcs, methods, types, consts and vars here
+	// analysis data
+	Analyzed bool           // If true then the type-checked Defines and Uses are known
+	Defines  []types.Object // Objects of the session defined by the Source: top-level declarations and variables of main
+	Uses     []types.Object // Objects of the session and of imported packages used by the Source
 }
 
 // Hide marks a SourceHolder as a hidden line ; they will not show up in source listing
@@ -34,8 +51,8 @@ func (s *SourceHolder) Hide() {
 }
 
 // NewImport creates a new SourceHolder of type Import
-func NewImport(entryCount int, source string, packageNames []string) SourceHolder {
-	return SourceHolder{EntryCount: entryCount, Type: Import, Source: source, PackageNames: packageNames}
+func NewImport(entryCount int, source string, imports []ImportSpec) SourceHolder {
+	return SourceHolder{EntryCount: entryCount, Type: Import, Source: source, Imports: imports}
 }
 
 // NewStatement creates a new SourceHolder of type Statement
@@ -61,32 +78,108 @@ func NewVariableAssign(entryCount int, source string, names []string) SourceHold
 		VariableNames: names}
 }
 
+// NewDeclaration creates a new SourceHolder of type Declaration
+func NewDeclaration(entryCount int, source string, names []string, variables []string) SourceHolder {
+	return SourceHolder{
+		EntryCount:    entryCount,
+		Type:          Declaration,
+		Source:        source,
+		DeclaredNames: names,
+		VariableNames: variables}
+}
+
 // NewPrint creates a new SourceHolder of type Print
 func NewPrint(entryCount int, source string) SourceHolder {
 	return SourceHolder{EntryCount: entryCount, Type: Print, Source: source, Hidden: true}
 }
 
-// AppendTo adds a new SourceHolder to the collection of entries.
-// As a side effect, it may produce additional SourceHolders based on its type.
-func (s SourceHolder) AppendTo(sourceLines []SourceHolder) []SourceHolder {
-	extended := append(sourceLines, s)
-	if VariableDecl == s.Type {
-		for _, each := range s.VariableNames {
-			uselessSource := fmt.Sprintf("_ = %s", each)
-			useless := NewStatement(s.EntryCount, uselessSource)
-			(&useless).Hide()
-			extended = append(extended, useless)
+// OutputMark returns the mark written by the generated program before the output of this holder
+func (s SourceHolder) OutputMark() int {
+	if Print == s.Type {
+		return printOutputMark
+	}
+	return s.EntryCount
+}
+
+// OutputMarkSource returns the Go source that precedes the Code on its line in the generated program
+func (s SourceHolder) OutputMarkSource() string {
+	if !s.MarksOutput {
+		return ""
+	}
+	return fmt.Sprintf("rango_mark(%d); ", s.OutputMark())
+}
+
+// Code returns the Go source generated for the Source.
+// Unused imports are imported for their side effects only and declared variables are used (_ = x) ;
+// the compiler does not accept either while entries are being added.
+func (s SourceHolder) Code() string {
+	code := s.Source
+	if Import == s.Type && len(s.UnusedImports) > 0 {
+		code = blankImports(code, s.UnusedImports)
+	}
+	if uses := s.blankUses(); len(uses) > 0 {
+		end := CodeEnd(code)
+		code = code[:end] + uses + code[end:]
+	}
+	if s.PrintsResults {
+		code = printResultsBegin + code + ")"
+	}
+	if s.OpensScope {
+		// closed at the end of the program
+		code = openScope + code
+	}
+	return code
+}
+
+// CodePrefix returns the Go source that precedes the Source on its line in the generated program
+func (s SourceHolder) CodePrefix() string {
+	prefix := s.OutputMarkSource()
+	if s.OpensScope {
+		prefix += openScope
+	}
+	if s.PrintsResults {
+		prefix += printResultsBegin
+	}
+	return prefix
+}
+
+// CodeEndColumn returns the column on the last line of the generated Source after which rango appends code
+func (s SourceHolder) CodeEndColumn() int {
+	end := CodeEnd(s.Source)
+	column := end - strings.LastIndex(s.Source[:end], "\n")
+	if s.Lines() == 1 {
+		column += len(s.CodePrefix())
+	}
+	return column
+}
+
+// Lines returns the number of lines of the Source
+func (s SourceHolder) Lines() int {
+	return strings.Count(s.Source, "\n") + 1
+}
+
+// blankUses returns the Go source that uses the variables declared by a VariableDecl, appended to its last line
+func (s SourceHolder) blankUses() string {
+	if VariableDecl != s.Type {
+		return ""
+	}
+	var buf bytes.Buffer
+	for _, each := range s.VariableNames {
+		if each != "_" {
+			fmt.Fprintf(&buf, "; _ = %s", each)
 		}
 	}
-	return extended
+	return buf.String()
+}
+
+// AppendTo adds a new SourceHolder to the collection of entries.
+func (s SourceHolder) AppendTo(sourceLines []SourceHolder) []SourceHolder {
+	return append(sourceLines, s)
 }
 
 // IsVariable says whether the receiver is known as declared Variable name.
 func (s SourceHolder) IsVariable(entry string) bool {
-	if s.Type != VariableDecl {
-		return false
-	}
-	for _, each := range s.VariableNames {
+	for _, each := range s.Variables() {
 		if each == entry {
 			return true
 		}
@@ -94,13 +187,101 @@ func (s SourceHolder) IsVariable(entry string) bool {
 	return false
 }
 
+// Variables returns the names of the variables declared by the receiver.
+// If analyzed then these are the type-checked variables ; otherwise the names found by parsing.
+func (s SourceHolder) Variables() []string {
+	if s.Analyzed {
+		names := []string{}
+		for _, each := range s.Defines {
+			if _, ok := each.(*types.Var); ok {
+				names = append(names, each.Name())
+			}
+		}
+		return names
+	}
+	if s.Type != VariableDecl && s.Type != Declaration {
+		return nil
+	}
+	return s.VariableNames
+}
+
 // CollectVariables returns the list of declared variable names entered by the user.
+// A variable declared again is listed once.
 func CollectVariables(sourceLines []SourceHolder) []string {
 	names := []string{}
 	for _, each := range sourceLines {
-		if VariableDecl == each.Type {
-			names = append(names, each.VariableNames...)
+		names = append(names, each.Variables()...)
+	}
+	return uniqueNames(names)
+}
+
+// CollectLocalVariables returns the list of variable names declared by the user inside main.
+func CollectLocalVariables(sourceLines []SourceHolder) []string {
+	names := []string{}
+	for _, each := range sourceLines {
+		if Declaration != each.Type {
+			names = append(names, each.Variables()...)
 		}
 	}
 	return names
 }
+
+// packageVariables returns the variables declared by the Declarations of the program that main does not declare again,
+// with the entry count of their Declaration.
+func packageVariables(sourceLines []SourceHolder) map[string]int {
+	local := map[string]bool{"_": true}
+	for _, each := range CollectLocalVariables(sourceLines) {
+		local[each] = true
+	}
+	variables := map[string]int{}
+	for i, each := range sourceLines {
+		if Declaration != each.Type || IsReplaced(sourceLines, i) {
+			continue
+		}
+		for _, name := range each.Variables() {
+			if !local[name] {
+				variables[name] = each.EntryCount
+			}
+		}
+	}
+	return variables
+}
+
+// partlyReplaced returns the entry count of an earlier Declaration that declares some of the names but also others,
+// with those other names. A new Declaration of the names would drop them. Return 0 if there is none.
+func partlyReplaced(sourceLines []SourceHolder, names []string) (int, []string) {
+	for i, each := range sourceLines {
+		if Declaration != each.Type || IsReplaced(sourceLines, i) {
+			continue
+		}
+		shared, others := false, []string{}
+		for _, name := range each.DeclaredNames {
+			if containsName(names, name) {
+				shared = true
+			} else {
+				others = append(others, name)
+			}
+		}
+		if shared && len(others) > 0 {
+			return each.EntryCount, others
+		}
+	}
+	return 0, nil
+}
+
+// IsReplaced says whether the Declaration at index i is replaced by a later Declaration of any of its names.
+func IsReplaced(sourceLines []SourceHolder, i int) bool {
+	for _, later := range sourceLines[i+1:] {
+		if Declaration != later.Type {
+			continue
+		}
+		for _, each := range later.DeclaredNames {
+			for _, other := range sourceLines[i].DeclaredNames {
+				if each == other {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
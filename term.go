@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/GeertJohan/go.linenoise"
@@ -10,30 +9,62 @@ import (
 
 var lastHistoryEntry string
 
+const (
+	prompt             = "> "
+	continuationPrompt = "... "
+)
+
 func loop() {
 	linenoise.LoadHistory(".rango-history")
 	for {
-		entered, err := linenoise.Line("> ")
-		if err != nil {
-			if err == linenoise.KillSignalError {
-				os.Exit(0)
-			}
-			fmt.Println("Unexpected error: %s", err)
-			os.Exit(0)
-		}
-		entry := strings.TrimLeft(entered, "\t ") // without tabs,spaces
-		var output string
-		if entry != lastHistoryEntry {
-			err = linenoise.AddHistory(entry)
-			if err != nil {
-				fmt.Printf("error: %s\n", entry)
-			}
-			lastHistoryEntry = entry
-			linenoise.SaveHistory(".rango-history")
-		}
-		output = dispatch(entry)
+		output := dispatch(readEntry())
 		if len(output) > 0 {
 			fmt.Println(output)
 		}
 	}
 }
+
+// readEntry reads lines until the entered source is complete.
+// An empty line at the continuation prompt ends the entry as is.
+func readEntry() string {
+	entry := readLine(prompt)
+	for needsContinuation(entry) {
+		more := readLine(continuationPrompt)
+		if len(more) == 0 {
+			break
+		}
+		entry += "\n" + more
+	}
+	return entry
+}
+
+// needsContinuation returns whether an entry is Go source that is not yet complete
+func needsContinuation(entry string) bool {
+	if len(entry) == 0 || strings.HasPrefix(entry, ".") {
+		return false
+	}
+	return IsIncomplete(strings.TrimLeft(entry, "=!"))
+}
+
+// readLine reads one line using the prompt and adds it to the history.
+// The terminal is in raw mode only while reading ; running programs read it in line mode.
+func readLine(prompt string) string {
+	entered, err := linenoise.Line(prompt)
+	if err != nil {
+		if err == linenoise.KillSignalError {
+			exit(0)
+		}
+		fmt.Printf("Unexpected error: %s\n", err)
+		exit(0)
+	}
+	entry := strings.TrimLeft(entered, "\t ") // without tabs,spaces
+	if entry != lastHistoryEntry {
+		err = linenoise.AddHistory(entry)
+		if err != nil {
+			fmt.Printf("error: %s\n", entry)
+		}
+		lastHistoryEntry = entry
+		linenoise.SaveHistory(".rango-history")
+	}
+	return entry
+}
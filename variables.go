@@ -0,0 +1,124 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+const (
+	// separates the dynamic types and values printed for the variables
+	valueSeparator = "\x1f"
+	// values longer than this are truncated
+	maxValueLength = 60
+)
+
+// sessionVariable is a variable in scope at the end of the entries
+type sessionVariable struct {
+	Name       string
+	Type       types.Type // static type ; nil if the entries are not analyzed
+	EntryCount int        // entry that declared the variable
+}
+
+// collectSessionVariables returns the variables in scope, in the order of the entries that declared them.
+// Only the latest declaration of a variable declared again is returned.
+func collectSessionVariables(sourceLines []SourceHolder) []sessionVariable {
+	variables := []sessionVariable{}
+	for _, each := range sourceLines {
+		for _, name := range each.Variables() {
+			variable := sessionVariable{Name: name, EntryCount: each.EntryCount}
+			for _, object := range each.Defines {
+				if object.Name() == name {
+					variable.Type = object.Type()
+				}
+			}
+			for i, other := range variables {
+				if other.Name == name {
+					variables = append(variables[:i], variables[i+1:]...)
+					break
+				}
+			}
+			variables = append(variables, variable)
+		}
+	}
+	return variables
+}
+
+// handleShowVariables returns a table of the variables with their types, values and declaring entry (.v [pattern]).
+// The optional pattern (e.g. user*) selects variables by name.
+func handleShowVariables(entry string) string {
+	fields := strings.Fields(entry)
+	pattern := "*"
+	if len(fields) > 1 {
+		pattern = fields[1]
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Sprintf("[rango] \"%s\": %v", pattern, err)
+	}
+	selected := []sessionVariable{}
+	for _, each := range collectSessionVariables(sourceLines) {
+		if matched, _ := path.Match(pattern, each.Name); matched {
+			selected = append(selected, each)
+		}
+	}
+	if len(selected) == 0 {
+		return "(no variables)"
+	}
+	// print the dynamic type and value of each variable
+	var printEntry bytes.Buffer
+	for i, each := range selected {
+		if i > 0 {
+			printEntry.WriteString("; ")
+		}
+		fmt.Fprintf(&printEntry, "rango_fmt.Printf(\"%%T%s%%#v%s\", %s, %s)", valueSeparator, valueSeparator, each.Name, each.Name)
+	}
+	addEntry(NewPrint(entryCount, printEntry.String()))
+	// the values are not shown but parsed
+	shown := live
+	live = nil
+	result := evaluate(printOutputMark)
+	live = shown
+	if result.Failed() {
+		return failureOutput(result, printOutputMark)
+	}
+	values := strings.Split(latestOutput(result, printOutputMark), valueSeparator)
+	var table bytes.Buffer
+	writer := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tTYPE\tDYNAMIC TYPE\tVALUE\tENTRY")
+	for i, each := range selected {
+		dynamicType, value := "", ""
+		if 2*i+1 < len(values) {
+			dynamicType, value = values[2*i], truncateValue(values[2*i+1])
+		}
+		staticType := dynamicType
+		if each.Type != nil {
+			staticType = typeString(each.Type)
+			if !types.IsInterface(each.Type) {
+				// only interesting for interfaces
+				dynamicType = ""
+			}
+		} else {
+			dynamicType = ""
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\n", each.Name, staticType, dynamicType, value, each.EntryCount)
+	}
+	writer.Flush()
+	return strings.TrimSuffix(table.String(), "\n")
+}
+
+// truncateValue shortens a printed value to at most maxValueLength characters
+func truncateValue(value string) string {
+	value = strings.Replace(value, "\n", " ", -1)
+	if utf8.RuneCountInString(value) <= maxValueLength {
+		return value
+	}
+	return string([]rune(value)[:maxValueLength-3]) + "..."
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHandleShowVariables(t *testing.T) {
+	fake := newSession(Result{})
+	dispatch("a := 1")
+	dispatch("var e error")
+	dispatch(`a := "text"`)
+	// ordered by the declaring entry
+	fake.result = Result{Stdout: "\x00rango:-1\x00<nil>\x1f<nil>\x1fstring\x1f\"text\"\x1f"}
+	lines := strings.Split(handleShowVariables(".v"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("lines=%q", lines)
+	}
+	if fields := strings.Fields(lines[2]); !equal([]string{"a", "string", `"text"`, "3"}, fields) {
+		t.Fatalf("fields=%q", fields)
+	}
+	if fields := strings.Fields(lines[1]); !equal([]string{"e", "error", "<nil>", "<nil>", "2"}, fields) {
+		t.Fatalf("fields=%q", fields)
+	}
+	if output := handleShowVariables(".v b*"); output != "(no variables)" {
+		t.Fatalf("output=%q", output)
+	}
+}
+
+func TestTruncateValue(t *testing.T) {
+	if value := truncateValue(strings.Repeat("x", 100)); len(value) != maxValueLength || !strings.HasSuffix(value, "...") {
+		t.Fatalf("value=%q", value)
+	}
+}
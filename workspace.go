@@ -0,0 +1,111 @@
+// Copyright 2013 Ernest Micklei. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	workspacePrefix = "rango-"
+	lockFileName    = "rango.lock"
+)
+
+var (
+	// directory with the files generated, compiled and run by this session
+	workspace = "."
+	// keep option
+	Keep = flag.Bool("keep", false, "keep the workspace directory of the session to inspect the generated files")
+)
+
+// workspacePath returns the path of a file in the workspace
+func workspacePath(name string) string {
+	return workspace + string(filepath.Separator) + name
+}
+
+// openWorkspace creates a temporary directory for the files of this session and locks it.
+// Workspaces left behind by sessions that are no longer running are removed first.
+func openWorkspace() error {
+	removeStaleWorkspaces()
+	dir, err := ioutil.TempDir("", workspacePrefix)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, lockFileName), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	workspace = dir
+	// inside a package, the module of the package is used
+	if len(packageName) == 0 {
+		if err := openModule(); err != nil {
+			os.RemoveAll(dir)
+			workspace = "."
+			return err
+		}
+	}
+	// also clean up if rango is stopped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-signals
+		exit(1)
+	}()
+	return nil
+}
+
+// closeWorkspace removes the workspace of this session, unless it must be kept
+func closeWorkspace() {
+	if workspace == "." {
+		return
+	}
+	if *Keep {
+		// no longer locked but not stale either
+		os.Remove(filepath.Join(workspace, lockFileName))
+		fmt.Printf("[rango] workspace kept in %s\n", workspace)
+		return
+	}
+	os.RemoveAll(workspace)
+}
+
+// removeStaleWorkspaces removes the workspaces that are locked by a process that is no longer running
+func removeStaleWorkspaces() {
+	dirs, _ := filepath.Glob(filepath.Join(os.TempDir(), workspacePrefix+"*"))
+	for _, each := range dirs {
+		data, err := ioutil.ReadFile(filepath.Join(each, lockFileName))
+		if err != nil {
+			// not locked ; kept or not a workspace
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && !isRunning(pid) {
+			os.RemoveAll(each)
+		}
+	}
+}
+
+// isRunning returns whether a process with the given id exists
+func isRunning(pid int) bool {
+	if pid <= 0 {
+		// would signal a process group
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// exit ends rango after removing the workspace
+func exit(code int) {
+	closeWorkspace()
+	os.Exit(code)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRemoveStaleWorkspaces(t *testing.T) {
+	temp, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(temp)
+	os.Setenv("TMPDIR", temp)
+	defer os.Unsetenv("TMPDIR")
+	stale := filepath.Join(temp, workspacePrefix+"stale")
+	running := filepath.Join(temp, workspacePrefix+"running")
+	kept := filepath.Join(temp, workspacePrefix+"kept")
+	for _, each := range []string{stale, running, kept} {
+		os.Mkdir(each, 0755)
+	}
+	// no process has a negative id
+	ioutil.WriteFile(filepath.Join(stale, lockFileName), []byte("-42"), 0644)
+	ioutil.WriteFile(filepath.Join(running, lockFileName), []byte(strconv.Itoa(os.Getpid())), 0644)
+	removeStaleWorkspaces()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("stale workspace not removed")
+	}
+	for _, each := range []string{running, kept} {
+		if _, err := os.Stat(each); err != nil {
+			t.Fatal(err)
+		}
+	}
+}